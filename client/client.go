@@ -2,9 +2,14 @@ package client
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 	"vpn/config"
@@ -13,12 +18,98 @@ import (
 	"vpn/protocol"
 )
 
+type State int
+
+const (
+	StateDisconnected State = iota
+	StateConnecting
+	StateConnected
+	StateReconnecting
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	default:
+		return "disconnected"
+	}
+}
+
+var errNotConnected = errors.New("not connected")
+
+type session struct {
+	conn      net.Conn
+	obfs      *protocol.Obfuscator
+	ip        string
+	ip6       string
+	keepAlive protocol.KeepAliveParams
+	tracker   *protocol.KeepAliveTracker
+	done      chan struct{}
+	once      sync.Once
+	wg        sync.WaitGroup
+	// writeMu serializes frames; it is never held together with Client.mu
+	writeMu sync.Mutex
+}
+
+// write sends message, giving up once the peer timeout passes so a stalled
+// connection is noticed.
+func (s *session) write(message *protocol.Message) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.keepAlive.Timeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.keepAlive.Timeout))
+	}
+	return s.obfs.WriteMessage(s.conn, message)
+}
+
+func (s *session) close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+// endpoint is one configured server address. addr is resolved once so
+// reconnects do not depend on DNS while the tunnel is down.
+type endpoint struct {
+	server  string
+	addr    string
+	latency time.Duration
+	err     error
+}
+
+type probe struct {
+	endpoint *endpoint
+	conn     *tls.Conn
+	latency  time.Duration
+	err      error
+}
+
 type Client struct {
-	config      *config.Config
-	conn        net.Conn
-	tun         *network.TUNInterface
-	routeManger *network.RouteManager
-	cipher      *crypto.Cipher
+	config         *config.Config
+	tun            *network.TUNInterface
+	routeManger    *network.RouteManager
+	dnsInterceptor *network.DNSInterceptor
+	dnsManager     *network.DNSManager
+	killSwitch     *network.KillSwitch
+	keepKillSwitch bool // the kill switch outlives this client, see HandOver
+	dnsGuard       *network.DNSLeakGuard
+	journal        *network.Journal
+	endpoints      []*endpoint
+	endpoint       *endpoint
+	cipher         *crypto.Cipher
+	session        *session
+	ticket         []byte
+	ip             string
+	ip6            string
+	state          State
+	connectedAt    time.Time
+	metrics        *clientMetrics
 
 	bytesIn  uint64
 	bytesOut uint64
@@ -29,53 +120,518 @@ type Client struct {
 }
 
 func NewClient(config *config.Config) (*Client, error) {
-	return &Client{
+	cipher, err := crypto.NewCipher(config.SharedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	client := &Client{
 		config:   config,
+		cipher:   cipher,
+		journal:  network.NewJournal(JournalFile(config.DataDir)),
 		stopChan: make(chan struct{}),
-	}, nil
+	}
+	client.metrics = newClientMetrics(client)
+	return client, nil
+}
+
+func (client *Client) dnsStateFile() string {
+	return filepath.Join(client.config.DataDir, "dns-state.json")
+}
+
+// JournalFile is where the client records how to undo its changes to the
+// host until it disconnects cleanly.
+func JournalFile(dataDir string) string {
+	return filepath.Join(dataDir, "journal")
+}
+
+// Cleanup reverts routes, DNS and firewall changes left behind by a client
+// that did not shut down cleanly.
+func Cleanup(dataDir string) error {
+	journal := network.NewJournal(JournalFile(dataDir))
+	pending, err := journal.Pending()
+	if err != nil {
+		return err
+	}
+	if pending == 0 {
+		return nil
+	}
+	logrus.Warnf("Reverting %d changes left by a previous run", pending)
+	return journal.Replay()
 }
 
 func (client *Client) Connect() error {
-	logrus.Infof("Connecting to VPN server %s", client.config.ServerAddr)
-	tlsConfig := crypto.NewClientTSLConfig(true)
-	conn, err := tls.Dial("tcp", client.config.ServerAddr, tlsConfig)
+	client.setState(StateConnecting)
+	// a kill switch taken over is in the journal, which the previous client
+	// left clean otherwise
+	if !client.keepKillSwitch {
+		if err := Cleanup(client.config.DataDir); err != nil {
+			logrus.Warnf("Failed to revert changes left by a previous run: %v", err)
+		}
+	}
+	var addrs []string
+	var err error
+	if client.endpoints != nil {
+		for _, ep := range client.endpoints {
+			addrs = append(addrs, ep.addr)
+		}
+	} else if addrs, err = client.resolveEndpoints(); err != nil {
+		client.setState(StateDisconnected)
+		return err
+	}
+	if client.keepKillSwitch {
+		if err := client.killSwitch.Update("", addrs, client.config.AllowLAN); err != nil {
+			client.setState(StateDisconnected)
+			return fmt.Errorf("failed to update kill switch: %v", err)
+		}
+	}
+	sess, err := client.dial()
+	if err != nil {
+		client.setState(StateDisconnected)
+		return err
+	}
+	tun, err := network.NewTUNInterface(sess.ip, client.config.VPNSubnet, client.config.MTU, false)
+	if err != nil {
+		sess.close()
+		client.setState(StateDisconnected)
+		return fmt.Errorf("failed to create tun interface: %v", err)
+	}
+	client.tun = tun
+	client.mu.Lock()
+	client.ip = sess.ip
+	client.mu.Unlock()
+	logrus.Infof("TUN interface %s created with IP %s", tun.Name(), sess.ip)
+	if sess.ip6 != "" {
+		ip6, _, _ := net.ParseCIDR(sess.ip6)
+		if err := tun.ConfigureIPv6(ip6.String(), sess.ip6, ""); err != nil {
+			logrus.Warnf("Failed to configure IPv6, tunneling IPv4 only: %v", err)
+		} else {
+			client.ip6 = sess.ip6
+			logrus.Infof("TUN interface %s has IPv6 address %s", tun.Name(), sess.ip6)
+		}
+	}
+	if client.keepKillSwitch {
+		if err := client.killSwitch.Update(tun.Name(), addrs, client.config.AllowLAN); err != nil {
+			sess.close()
+			tun.Close()
+			client.setState(StateDisconnected)
+			return fmt.Errorf("failed to update kill switch: %v", err)
+		}
+	} else if client.config.KillSwitch {
+		client.killSwitch = network.NewKillSwitch(tun.Name(), addrs, client.config.AllowLAN)
+		client.killSwitch.SetJournal(client.journal)
+		if err := client.killSwitch.Enable(); err != nil {
+			client.killSwitch = nil
+			sess.close()
+			tun.Close()
+			client.setState(StateDisconnected)
+			return fmt.Errorf("failed to enable kill switch: %v", err)
+		}
+	}
+	include, dnsServers := client.config.IncludeRoutes, client.config.DNS
+	if len(client.config.DomainRules) > 0 {
+		// domain rules imply split tunneling; the tunnel resolvers must be
+		// reachable through the tunnel
+		if len(include) == 0 {
+			for _, dns := range client.config.DNS {
+				include = append(include, dns+"/32")
+			}
+		}
+		listenHost, _, _ := net.SplitHostPort(client.config.DNSListen)
+		dnsServers = []string{listenHost}
+	}
+	client.routeManger = network.NewRouteManager(tun.Name(), addrs)
+	client.routeManger.SetPolicyRouting(client.config.RouteTable, client.config.FwMark)
+	client.routeManger.SetJournal(client.journal)
+	client.routeManger.SetIPv6(client.ip6 != "")
+	// split tunnels leave everything else, IPv6 included, on the local network
+	client.routeManger.SetBlockIPv6(client.config.BlockIPv6 && len(include) == 0)
+	err = client.routeManger.SetSplitRoutes(include, client.config.ExcludeRoutes)
+	if err == nil {
+		err = client.routeManger.SetupClientRoutes()
+	}
+	if err == nil && len(client.config.DomainRules) > 0 {
+		client.dnsInterceptor = network.NewDNSInterceptor(client.config.DNSListen, client.routeManger,
+			client.config.DomainRules, client.config.DNS, client.config.DNSUpstreams)
+		client.dnsInterceptor.SetIPv6(client.ip6 != "")
+		if err = client.dnsInterceptor.Start(); err != nil {
+			client.dnsInterceptor = nil
+		}
+	}
+	if err != nil {
+		sess.close()
+		client.restoreSystem()
+		tun.Close()
+		client.setState(StateDisconnected)
+		return fmt.Errorf("failed to setup client routes: %v", err)
+	}
+	if client.config.BlockDNSLeaks && len(client.config.DNSDomains) == 0 {
+		// with dns-domains, queries outside those zones go to the host's own
+		// resolvers on purpose; the interceptor's upstreams are allowed below
+		resolvers := append(append([]string{}, client.config.DNS...), client.config.DNSUpstreams...)
+		client.dnsGuard = network.NewDNSLeakGuard(resolvers)
+		client.dnsGuard.SetJournal(client.journal)
+		if err := client.dnsGuard.Enable(); err != nil {
+			logrus.Warnf("Failed to enable DNS leak protection: %v", err)
+			client.dnsGuard = nil
+		}
+	}
+	client.dnsManager = network.NewDNSManager(tun.Name(), client.dnsStateFile())
+	client.dnsManager.SetJournal(client.journal)
+	if err := client.dnsManager.Apply(dnsServers, client.config.DNSDomains); err != nil {
+		logrus.Warnf("Failed to setup DNS: %v", err)
+	}
+
+	if client.keepKillSwitch {
+		client.keepKillSwitch = false
+		if !client.config.KillSwitch {
+			client.killSwitch.Disable()
+			client.killSwitch = nil
+		}
+	}
+	client.startSession(sess)
+	client.wg.Add(2)
+	go client.tunReader()
+	go client.supervisor()
+	return nil
+}
+
+// HandOver disconnects like Disconnect but leaves the kill switch up, so
+// nothing leaves outside the tunnel until the next client, which gets it with
+// TakeOver, is connected. It returns nil without a kill switch.
+func (client *Client) HandOver() (*network.KillSwitch, error) {
+	client.keepKillSwitch = client.killSwitch != nil
+	if err := client.Disconnect(); err != nil {
+		return nil, err
+	}
+	return client.killSwitch, nil
+}
+
+// TakeOver makes Connect keep killSwitch, left up by HandOver of the previous
+// client, instead of enabling a new one. If Connect fails the kill switch
+// stays up for the next attempt.
+func (client *Client) TakeOver(killSwitch *network.KillSwitch) error {
+	if killSwitch == nil {
+		return nil
+	}
+	client.killSwitch = killSwitch
+	client.keepKillSwitch = true
+	return killSwitch.MoveJournal(client.journal)
+}
+
+// Resolve looks up the servers before Connect, e.g. while the tunnel of the
+// client this one replaces still carries DNS; Connect does it otherwise.
+func (client *Client) Resolve() error {
+	_, err := client.resolveEndpoints()
+	return err
+}
+
+// resolveEndpoints resolves every configured server; unresolvable ones are
+// skipped. It returns the addresses that must stay reachable outside the
+// tunnel.
+func (client *Client) resolveEndpoints() ([]string, error) {
+	client.endpoints = nil
+	var addrs []string
+	for _, server := range client.config.Servers {
+		server = strings.TrimSpace(server)
+		addr, err := net.ResolveTCPAddr("tcp", server)
+		if err != nil {
+			logrus.Warnf("Failed to resolve server address %s: %v", server, err)
+			continue
+		}
+		client.endpoints = append(client.endpoints, &endpoint{server: server, addr: addr.String()})
+		addrs = append(addrs, addr.String())
+	}
+	if len(client.endpoints) == 0 {
+		return nil, fmt.Errorf("failed to resolve server address %s", strings.Join(client.config.Servers, ", "))
+	}
+	return addrs, nil
+}
+
+// dial opens TLS connections to all endpoints at once and authenticates over
+// the first one to complete, which is the one with the lowest latency. If the
+// server rejects it the next fastest is used.
+func (client *Client) dial() (*session, error) {
+	probes := make(chan probe, len(client.endpoints))
+	for _, ep := range client.endpoints {
+		go func(ep *endpoint) {
+			start := time.Now()
+			conn, err := client.dialTLS(ep)
+			probes <- probe{endpoint: ep, conn: conn, latency: time.Since(start), err: err}
+		}(ep)
+	}
+	var errs []string
+	for pending := len(client.endpoints); pending > 0; pending-- {
+		result := <-probes
+		client.recordProbe(result)
+		if result.err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", result.endpoint.server, result.err))
+			continue
+		}
+		logrus.Infof("Connecting to VPN server %s (%s, %v)", result.endpoint.server, result.endpoint.addr,
+			result.latency.Round(time.Millisecond))
+		sess, err := client.handshake(result.conn)
+		if err != nil {
+			client.metrics.handshakes.WithLabelValues("failed").Inc()
+			result.conn.Close()
+			errs = append(errs, fmt.Sprintf("%s: %v", result.endpoint.server, err))
+			continue
+		}
+		client.metrics.handshakes.WithLabelValues("ok").Inc()
+		client.mu.Lock()
+		client.endpoint = result.endpoint
+		client.mu.Unlock()
+		// the slower probes still finish so their latency shows in the status
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				result := <-probes
+				client.recordProbe(result)
+				if result.conn != nil {
+					result.conn.Close()
+				}
+			}
+		}(pending - 1)
+		return sess, nil
+	}
+	if len(errs) == 1 {
+		return nil, fmt.Errorf("failed to connect to server: %s", errs[0])
+	}
+	return nil, fmt.Errorf("failed to connect to any server: %s", strings.Join(errs, "; "))
+}
+
+func (client *Client) dialTLS(ep *endpoint) (*tls.Conn, error) {
+	host, _, err := net.SplitHostPort(ep.server)
 	if err != nil {
-		return fmt.Errorf("failed to connect to server: %v", err)
+		return nil, fmt.Errorf("invalid server address: %v", err)
 	}
-	client.conn = conn
-	cipher, err := crypto.NewCipher(client.config.SharedKey)
+	tlsConfig, err := crypto.NewClientTSLConfig(crypto.ClientTLSOptions{
+		ServerName:      host,
+		CertFile:        client.config.TLSCert,
+		KeyFile:         client.config.TLSKey,
+		CertPEM:         []byte(client.config.TLSCertPEM),
+		KeyPEM:          []byte(client.config.TLSKeyPEM),
+		CAFile:          client.config.TLSCA,
+		Pin:             client.config.ServerPin,
+		TrustOnFirstUse: client.config.TrustOnFirstUse,
+		KnownHostsFile:  filepath.Join(client.config.DataDir, "known_hosts"),
+	})
 	if err != nil {
-		return fmt.Errorf("failed to create cipher: %v", err)
+		return nil, fmt.Errorf("failed to create tls config: %v", err)
+	}
+	dialer := &net.Dialer{
+		Timeout: client.config.HandshakeTimeout,
+		Control: network.SocketMarkControl(client.config.FwMark),
 	}
-	client.cipher = cipher
-	handshakeMessage := protocol.CreateHandshake(protocol.TypeHandshake, client.config.ClientIP, client.config.SharedKey)
+	return tls.DialWithDialer(dialer, "tcp", ep.addr, tlsConfig)
+}
+
+func (client *Client) recordProbe(result probe) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	result.endpoint.latency, result.endpoint.err = result.latency, result.err
+}
+
+func (client *Client) handshake(conn net.Conn) (*session, error) {
+	conn.SetDeadline(time.Now().Add(client.config.HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	ext := protocol.Extensions{}
+	if client.config.Obfuscate {
+		ext[protocol.ExtObfuscation] = protocol.ObfsParams{
+			MaxPadding:    client.config.ObfsMaxPadding,
+			Bucket:        client.config.ObfsBucket,
+			Jitter:        client.config.ObfsJitter,
+			CoverInterval: client.config.ObfsCoverInterval,
+		}.Marshal()
+	}
+	// an empty request lets the server pick the address
+	ext[protocol.ExtIPv6] = []byte(client.config.ClientIP6)
+	ext[protocol.ExtKeepAlive] = protocol.KeepAliveParams{
+		Interval: client.config.KeepAlive,
+		Timeout:  client.config.Timeout,
+	}.Marshal()
+	client.mu.Lock()
+	if client.ticket != nil {
+		ext[protocol.ExtSessionTicket] = client.ticket
+	}
+	// once the tunnel is up, keep the address it was set up with
+	ip := client.ip
+	client.mu.Unlock()
+	if ip == "" {
+		ip = client.config.ClientIP
+	}
+	handshakeMessage := protocol.CreateHandshake(protocol.TypeHandshake, ip, client.config.SharedKey, ext)
 	if err := protocol.WriteMessage(conn, handshakeMessage); err != nil {
-		return fmt.Errorf("failed to write handshake message: %v", err)
+		return nil, fmt.Errorf("failed to write handshake message: %v", err)
 	}
 	message, err := protocol.ReadMessage(conn)
 	if err != nil {
-		return fmt.Errorf("failed to read handshake response: %v", err)
+		return nil, fmt.Errorf("failed to read handshake response: %v", err)
+	}
+	if message.Header.Type == protocol.TypeError {
+		return nil, fmt.Errorf("server rejected handshake: %s", message.Data)
 	}
 	if message.Header.Type != protocol.TypeHandshakeAck {
-		return fmt.Errorf("expected hanshakeAck, but got: %v", message.Header.Type)
+		return nil, fmt.Errorf("expected hanshakeAck, but got: %v", message.Header.Type)
 	}
-	logrus.Info("Successfully authenticated with server")
-	tun, err := network.NewTUNInterface(client.config.ClientIP, client.config.VPNSubnet, client.config.MTU, false)
+	ackExt, err := protocol.ParseHandshakeAck(message.Data)
 	if err != nil {
-		return fmt.Errorf("failed to create tun interface: %v", err)
+		return nil, fmt.Errorf("failed to parse handshake ack: %v", err)
 	}
-	client.tun = tun
-	logrus.Infof("TUN interface %s created with IP %s", tun.Name(), client.config.ClientIP)
-	client.routeManger = network.NewRouteManager(tun.Name(), client.config.ServerAddr, client.config.DNS)
-	if err := client.routeManger.SetupClientRoutes(); err != nil {
-		return fmt.Errorf("failed to setup client routes: %v", err)
+	logrus.Info("Successfully authenticated with server")
+	sess := &session{
+		conn:    conn,
+		ip:      ip,
+		tracker: protocol.NewKeepAliveTracker(),
+		keepAlive: protocol.KeepAliveParams{
+			Interval: client.config.KeepAlive,
+			Timeout:  client.config.Timeout,
+		},
+		done: make(chan struct{}),
+	}
+	if data, ok := ackExt[protocol.ExtObfuscation]; ok {
+		params, err := protocol.ParseObfsParams(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse obfuscation params: %v", err)
+		}
+		sess.obfs = protocol.NewObfuscator(params)
+		logrus.Info("Traffic obfuscation enabled")
+	} else if client.config.Obfuscate {
+		logrus.Warn("Server does not support traffic obfuscation")
+	}
+	if data, ok := ackExt[protocol.ExtIPv4]; ok {
+		assigned := net.ParseIP(string(data))
+		if assigned == nil || assigned.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 assignment %q", data)
+		}
+		if sess.ip = assigned.String(); sess.ip != ip {
+			logrus.Infof("Server assigned IP %s instead of %s", sess.ip, ip)
+		}
+	}
+	if data, ok := ackExt[protocol.ExtIPv6]; ok {
+		if _, _, err := net.ParseCIDR(string(data)); err != nil {
+			return nil, fmt.Errorf("invalid IPv6 assignment %q", data)
+		}
+		sess.ip6 = string(data)
+	}
+	if data, ok := ackExt[protocol.ExtKeepAlive]; ok {
+		params, err := protocol.ParseKeepAliveParams(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse keepalive params: %v", err)
+		}
+		sess.keepAlive = params
+		logrus.Debugf("Keepalive every %v, peer timeout %v", params.Interval, params.Timeout)
+	}
+	if ticket, ok := ackExt[protocol.ExtSessionTicket]; ok {
+		client.mu.Lock()
+		client.ticket = ticket
+		client.mu.Unlock()
 	}
+	return sess, nil
+}
 
-	client.wg.Add(3)
-	go client.tunReader()
-	go client.serverReader()
-	go client.keepAlive()
-	return nil
+func (client *Client) startSession(sess *session) bool {
+	client.mu.Lock()
+	select {
+	case <-client.stopChan:
+		client.mu.Unlock()
+		sess.close()
+		return false
+	default:
+	}
+	client.session = sess
+	client.mu.Unlock()
+	client.setState(StateConnected)
+	sess.wg.Add(3)
+	go client.serverReader(sess)
+	go client.keepAlive(sess)
+	go client.coverTraffic(sess)
+	return true
+}
+
+// connectionLost ends sess; the supervisor notices and reconnects.
+func (client *Client) connectionLost(sess *session) {
+	sess.close()
+}
+
+// supervisor waits for the current session to end and replaces it.
+func (client *Client) supervisor() {
+	defer client.wg.Done()
+	for {
+		client.mu.Lock()
+		sess := client.session
+		client.mu.Unlock()
+		if sess == nil {
+			return
+		}
+		select {
+		case <-client.stopChan:
+			return
+		case <-sess.done:
+		}
+		client.mu.Lock()
+		if client.session == sess {
+			client.session = nil
+		}
+		client.mu.Unlock()
+		sess.wg.Wait()
+		select {
+		case <-client.stopChan:
+			return
+		default:
+		}
+		client.setState(StateReconnecting)
+		if !client.reconnect() {
+			return
+		}
+	}
+}
+
+func (client *Client) reconnect() bool {
+	delay := client.config.ReconnectDelay
+	for attempt := 1; ; attempt++ {
+		// wait between half and all of the current backoff so clients spread out
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		logrus.Infof("Reconnecting in %v (attempt %d)", wait.Round(time.Millisecond), attempt)
+		select {
+		case <-client.stopChan:
+			return false
+		case <-time.After(wait):
+		}
+		sess, err := client.dial()
+		client.mu.Lock()
+		ip, ip6 := client.ip, client.ip6
+		client.mu.Unlock()
+		if err == nil && sess.ip != ip {
+			// the tunnel keeps its address; retry until the server can give it back
+			sess.close()
+			err = fmt.Errorf("server assigned IP %s instead of %s", sess.ip, ip)
+		}
+		if err == nil {
+			if sess.ip6 != ip6 {
+				logrus.Warnf("Server assigned IPv6 %q instead of %q, reconnect to apply it", sess.ip6, ip6)
+			}
+			client.metrics.reconnects.Inc()
+			return client.startSession(sess)
+		}
+		logrus.Warnf("Reconnect failed: %v", err)
+		delay *= 2
+		if delay > client.config.ReconnectMaxDelay {
+			delay = client.config.ReconnectMaxDelay
+		}
+	}
+}
+
+func (client *Client) send(message *protocol.Message) error {
+	client.mu.Lock()
+	sess := client.session
+	client.mu.Unlock()
+	if sess == nil {
+		return errNotConnected
+	}
+	err := sess.write(message)
+	if err != nil {
+		client.connectionLost(sess)
+	}
+	return err
 }
 
 func (client *Client) tunReader() {
@@ -88,88 +644,127 @@ func (client *Client) tunReader() {
 		default:
 			n, err := client.tun.Read(buffer)
 			if err != nil {
+				client.metrics.tunErrors.WithLabelValues("read").Inc()
 				logrus.Errorf("Failed to read from tun interface: %v", err)
+				continue
 			}
 			packet, err := protocol.ParseIPPacket(buffer[:n])
 			if err == nil {
 				logrus.Debugf("Read %s packet from TUN: %s to %s (%d bytes)",
 					packet.ProtocolName(), packet.SrcIp, packet.DstIp, n)
+				if protocol.IsDNS(packet) {
+					logrus.Debugf("DNS query to %s goes through the tunnel", packet.DstIp)
+				}
 			}
 			ciphertext, err := client.cipher.Encrypt(buffer[:n])
 			if err != nil {
+				client.metrics.dropped.WithLabelValues("encrypt_error").Inc()
 				logrus.Errorf("Failed to encrypt packet: %v", err)
 				continue
 			}
 			message := protocol.NewMessage(protocol.TypeData, ciphertext)
-			client.mu.Lock()
-			err = protocol.WriteMessage(client.conn, message)
-			if err == nil {
-				client.bytesOut += uint64(n)
+			err = client.send(message)
+			if err == errNotConnected {
+				client.metrics.dropped.WithLabelValues("not_connected").Inc()
+				logrus.Debugf("Dropping %d bytes while not connected", n)
+				continue
 			}
-			client.mu.Unlock()
 			if err != nil {
+				client.metrics.dropped.WithLabelValues("send_error").Inc()
 				logrus.Errorf("Failed to send data to server: %v", err)
-				return
+				continue
 			}
+			client.mu.Lock()
+			client.bytesOut += uint64(n)
+			client.mu.Unlock()
+			client.metrics.transferred("out", n)
 		}
 	}
 }
 
-func (client *Client) serverReader() {
-	defer client.wg.Done()
+func (client *Client) serverReader(sess *session) {
+	defer sess.wg.Done()
 	for {
-		select {
-		case <-client.stopChan:
+		message, err := sess.obfs.ReadMessage(sess.conn)
+		if err != nil {
+			select {
+			case <-sess.done:
+			default:
+				logrus.Errorf("Failed to read from server: %v", err)
+				client.connectionLost(sess)
+			}
 			return
-		default:
-			message, err := protocol.ReadMessage(client.conn)
+		}
+		switch message.Header.Type {
+		case protocol.TypeData:
+			plaintext, err := client.cipher.Decrypt(message.Data)
 			if err != nil {
-				logrus.Errorf("Failed to read from server: %v", err)
-				return
+				client.metrics.decryptFailures.Inc()
+				logrus.Errorf("Failed to decrypt data: %v", err)
+				continue
 			}
-			switch message.Header.Type {
-			case protocol.TypeData:
-				plaintext, err := client.cipher.Decrypt(message.Data)
-				if err != nil {
-					logrus.Errorf("Failed to decrypt data: %v", err)
-					continue
-				}
-				packet, err := protocol.ParseIPPacket(plaintext)
-				if err == nil {
-					logrus.Debugf("Received %s packet from server: %s to %s (%d bytes)",
-						packet.ProtocolName(), packet.SrcIp, packet.DstIp, len(plaintext))
-				}
-				if _, err := client.conn.Write(plaintext); err != nil {
-					logrus.Errorf("Failed to write to TUN: %v", err)
-				}
-				client.mu.Lock()
-				client.bytesIn += uint64(len(plaintext))
-				client.mu.Unlock()
+			packet, err := protocol.ParseIPPacket(plaintext)
+			if err == nil {
+				logrus.Debugf("Received %s packet from server: %s to %s (%d bytes)",
+					packet.ProtocolName(), packet.SrcIp, packet.DstIp, len(plaintext))
+			}
+			if _, err := client.tun.Write(plaintext); err != nil {
+				client.metrics.tunErrors.WithLabelValues("write").Inc()
+				logrus.Errorf("Failed to write to TUN: %v", err)
+				continue
+			}
+			client.mu.Lock()
+			client.bytesIn += uint64(len(plaintext))
+			client.mu.Unlock()
+			client.metrics.transferred("in", len(plaintext))
 
-			case protocol.TypeKeepAlive:
-				logrus.Debug("Received keep-alive from server")
-			case protocol.TypeDisconnect:
+		case protocol.TypeKeepAlive:
+			if len(message.Data) == 0 {
+				// servers without numbered keepalives echo an empty one
+				sess.tracker.Alive()
+				continue
+			}
+			reply, rtt, err := sess.tracker.Handle(message.Data)
+			if err != nil {
+				logrus.Warnf("Ignoring keepalive: %v", err)
+				continue
+			}
+			if reply != nil {
+				if err := client.send(reply); err != nil {
+					logrus.Errorf("Failed to answer keepalive: %v", err)
+				}
+				continue
+			}
+			client.metrics.keepAliveRTT.Observe(rtt.Seconds())
+			logrus.Debugf("Received keep-alive from server (rtt %v)", rtt)
+		case protocol.TypeDisconnect:
+			if len(message.Data) > 0 {
+				logrus.Infof("Server requested disconnect: %s", message.Data)
+			} else {
 				logrus.Info("Server requested disconnect")
-				return
 			}
+			client.connectionLost(sess)
+			return
 		}
 	}
 }
 
-func (client *Client) keepAlive() {
-	defer client.wg.Done()
-	ticker := time.NewTicker(client.config.KeepAlive)
+func (client *Client) keepAlive(sess *session) {
+	defer sess.wg.Done()
+	ticker := time.NewTicker(sess.keepAlive.Interval)
 	defer ticker.Stop()
+	maxMissed := sess.keepAlive.MaxMissed()
 	for {
 		select {
-		case <-client.stopChan:
+		case <-sess.done:
 			return
 		case <-ticker.C:
-			message := protocol.NewMessage(protocol.TypeKeepAlive, nil)
-			client.mu.Lock()
-			err := protocol.WriteMessage(client.conn, message)
-			client.mu.Unlock()
-			if err != nil {
+			if missed := sess.tracker.Missed(); missed >= maxMissed {
+				logrus.Warnf("Server did not answer %d keepalives, reconnecting", missed)
+				client.connectionLost(sess)
+				return
+			}
+			if err := client.send(sess.tracker.Ping()); err != nil {
 				logrus.Errorf("Failed to send keepalive: %v", err)
 				return
 			}
@@ -177,29 +772,177 @@ func (client *Client) keepAlive() {
 	}
 }
 
+func (client *Client) coverTraffic(sess *session) {
+	defer sess.wg.Done()
+	sess.obfs.RunCover(sess.done, client.send)
+}
+
+func (client *Client) setState(state State) {
+	client.mu.Lock()
+	previous := client.state
+	client.state = state
+	if state == StateConnected && previous != StateConnected {
+		client.connectedAt = time.Now()
+	}
+	client.mu.Unlock()
+	if previous != state {
+		logrus.Infof("Connection state: %s -> %s", previous, state)
+	}
+}
+
+func (client *Client) State() State {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.state
+}
+
+type Status struct {
+	State          string           `json:"state"`
+	Profile        string           `json:"profile,omitempty"`
+	Server         string           `json:"server"`
+	Endpoint       string           `json:"endpoint"`
+	Endpoints      []EndpointStatus `json:"endpoints,omitempty"`
+	IP             string           `json:"ip"`
+	IP6            string           `json:"ip6,omitempty"`
+	ConnectedSince time.Time        `json:"connected_since"`
+	BytesIn        uint64           `json:"bytes_in"`
+	BytesOut       uint64           `json:"bytes_out"`
+	RTT            float64          `json:"rtt_ms,omitempty"`
+	Jitter         float64          `json:"jitter_ms,omitempty"`
+}
+
+// EndpointStatus is the result of the last probe of a server address.
+type EndpointStatus struct {
+	Server  string  `json:"server"`
+	Address string  `json:"address"`
+	Latency float64 `json:"latency_ms,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+func (client *Client) Status() Status {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	status := Status{
+		State:    client.state.String(),
+		Profile:  client.config.Profile,
+		IP:       client.ip,
+		IP6:      client.ip6,
+		BytesIn:  client.bytesIn,
+		BytesOut: client.bytesOut,
+	}
+	if status.IP == "" {
+		status.IP = client.config.ClientIP
+	}
+	if client.endpoint != nil {
+		status.Server = client.endpoint.server
+		status.Endpoint = client.endpoint.addr
+	}
+	if len(client.endpoints) > 1 {
+		for _, ep := range client.endpoints {
+			endpointStatus := EndpointStatus{Server: ep.server, Address: ep.addr}
+			if ep.err != nil {
+				endpointStatus.Error = ep.err.Error()
+			} else {
+				endpointStatus.Latency = milliseconds(ep.latency)
+			}
+			status.Endpoints = append(status.Endpoints, endpointStatus)
+		}
+	}
+	if client.state == StateConnected {
+		status.ConnectedSince = client.connectedAt
+	}
+	if client.session != nil {
+		rtt, jitter := client.session.tracker.RTT()
+		status.RTT = milliseconds(rtt)
+		status.Jitter = milliseconds(jitter)
+	}
+	return status
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Reconnect drops the current session; the supervisor then dials again.
+func (client *Client) Reconnect() error {
+	client.mu.Lock()
+	sess := client.session
+	client.mu.Unlock()
+	if sess == nil {
+		return errNotConnected
+	}
+	logrus.Info("Reconnect requested")
+	client.connectionLost(sess)
+	return nil
+}
+
 func (client *Client) GetStats() (bytesIn, bytesOut uint64) {
 	client.mu.Lock()
 	defer client.mu.Unlock()
 	return client.bytesIn, client.bytesOut
 }
 
-func (client *Client) Disconnect() error {
-	logrus.Info("Disconnecting from VPN server")
-	close(client.stopChan)
-	if client.conn != nil {
-		message := protocol.NewMessage(protocol.TypeDisconnect, nil)
-		protocol.WriteMessage(client.conn, message)
-		client.conn.Close()
+func (client *Client) restoreSystem() {
+	clean := true
+	if client.dnsManager != nil {
+		if err := client.dnsManager.Restore(); err != nil {
+			logrus.Warnf("Failed to restore DNS: %v", err)
+			clean = false
+		}
+	}
+	if client.dnsInterceptor != nil {
+		client.dnsInterceptor.Stop()
 	}
-	client.wg.Wait()
 	if client.routeManger != nil {
 		if err := client.routeManger.RestoreRoutes(); err != nil {
 			logrus.Warnf("Failed to restore routes: %v", err)
+			clean = false
 		}
 	}
+	if client.dnsGuard != nil {
+		if err := client.dnsGuard.Disable(); err != nil {
+			logrus.Warnf("Failed to disable DNS leak protection: %v", err)
+			clean = false
+		}
+	}
+	if client.killSwitch != nil && !client.keepKillSwitch {
+		if err := client.killSwitch.Disable(); err != nil {
+			logrus.Warnf("Failed to disable kill switch: %v", err)
+			clean = false
+		}
+	}
+	if !clean {
+		logrus.Warnf("Run '%s cleanup' to retry reverting the remaining changes", filepath.Base(os.Args[0]))
+		return
+	}
+	if err := client.journal.Clear(); err != nil {
+		logrus.Warnf("Failed to clear journal: %v", err)
+	}
+	if client.killSwitch != nil && client.keepKillSwitch {
+		if err := client.killSwitch.Record(); err != nil {
+			logrus.Warnf("Failed to journal the kill switch: %v", err)
+		}
+	}
+}
+
+func (client *Client) Disconnect() error {
+	logrus.Info("Disconnecting from VPN server")
+	close(client.stopChan)
+	client.mu.Lock()
+	sess := client.session
+	client.session = nil
+	client.mu.Unlock()
+	if sess != nil {
+		sess.write(protocol.NewMessage(protocol.TypeDisconnect, nil))
+		sess.close()
+		sess.wg.Wait()
+	}
 	if client.tun != nil {
 		client.tun.Close()
 	}
+	client.wg.Wait()
+	client.restoreSystem()
+	client.setState(StateDisconnected)
 	logrus.Info("Successfully disconnected from VPN server")
 	return nil
 }
@@ -0,0 +1,26 @@
+package client
+
+import (
+	"encoding/json"
+	"vpn/control"
+)
+
+type Stats struct {
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+}
+
+// RegisterControl exposes the client on a control socket: status and stats to
+// everyone, reconnect to privileged callers.
+func (client *Client) RegisterControl(server *control.Server) {
+	server.Handle("status", false, func(json.RawMessage) (interface{}, error) {
+		return client.Status(), nil
+	})
+	server.Handle("stats", false, func(json.RawMessage) (interface{}, error) {
+		bytesIn, bytesOut := client.GetStats()
+		return Stats{BytesIn: bytesIn, BytesOut: bytesOut}, nil
+	})
+	server.Handle("reconnect", true, func(json.RawMessage) (interface{}, error) {
+		return nil, client.Reconnect()
+	})
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"vpn/metrics"
+)
+
+type clientMetrics struct {
+	registry        *prometheus.Registry
+	handshakes      *prometheus.CounterVec
+	reconnects      prometheus.Counter
+	bytes           *prometheus.CounterVec
+	packets         *prometheus.CounterVec
+	decryptFailures prometheus.Counter
+	tunErrors       *prometheus.CounterVec
+	dropped         *prometheus.CounterVec
+	keepAliveRTT    prometheus.Histogram
+}
+
+func newClientMetrics(client *Client) *clientMetrics {
+	m := &clientMetrics{
+		registry: prometheus.NewRegistry(),
+		handshakes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace, Subsystem: "client", Name: "handshakes_total",
+			Help: "Handshakes with the server by result (ok, failed).",
+		}, []string{"result"}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metrics.Namespace, Subsystem: "client", Name: "reconnects_total",
+			Help: "Sessions re-established after the connection was lost.",
+		}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace, Subsystem: "client", Name: "bytes_total",
+			Help: "Tunneled IP bytes by direction (out is client to server).",
+		}, []string{"direction"}),
+		packets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace, Subsystem: "client", Name: "packets_total",
+			Help: "Tunneled IP packets by direction.",
+		}, []string{"direction"}),
+		decryptFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metrics.Namespace, Subsystem: "client", Name: "decrypt_failures_total",
+			Help: "Data messages that failed to decrypt.",
+		}),
+		tunErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace, Subsystem: "client", Name: "tun_errors_total",
+			Help: "TUN device errors by operation (read, write).",
+		}, []string{"op"}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace, Subsystem: "client", Name: "dropped_packets_total",
+			Help: "Packets dropped by reason.",
+		}, []string{"reason"}),
+		keepAliveRTT: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metrics.Namespace, Subsystem: "client", Name: "keepalive_rtt_seconds",
+			Help:    "Round trip time of keepalives to the server.",
+			Buckets: metrics.RTTBuckets,
+		}),
+	}
+	connected := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace, Subsystem: "client", Name: "connected",
+		Help: "1 while a session with the server is up.",
+	}, func() float64 {
+		if client.State() == StateConnected {
+			return 1
+		}
+		return 0
+	})
+	m.registry.MustRegister(m.handshakes, m.reconnects, m.bytes, m.packets, m.decryptFailures,
+		m.tunErrors, m.dropped, m.keepAliveRTT, connected)
+	return m
+}
+
+func (m *clientMetrics) transferred(direction string, n int) {
+	m.bytes.WithLabelValues(direction).Add(float64(n))
+	m.packets.WithLabelValues(direction).Inc()
+}
+
+// MetricsRegistry holds the client's Prometheus metrics.
+func (client *Client) MetricsRegistry() *prometheus.Registry {
+	return client.metrics.registry
+}
@@ -0,0 +1,90 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore keeps the state in a JSON file that all nodes reach, e.g. on NFS.
+// Updates hold an exclusive lock on <path>.lock; mu serializes the callers of
+// this process, which share the lock.
+type FileStore struct {
+	path string
+	lock *os.File
+	mu   sync.Mutex
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStore{path: path, lock: lock}, nil
+}
+
+func (s *FileStore) Load() (*State, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := lockFile(s.lock, false); err != nil {
+		return nil, err
+	}
+	defer unlockFile(s.lock)
+	return s.read()
+}
+
+func (s *FileStore) Update(fn func(*State) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := lockFile(s.lock, true); err != nil {
+		return err
+	}
+	defer unlockFile(s.lock)
+	state, err := s.read()
+	if err != nil {
+		return err
+	}
+	if err := fn(state); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// readers without the lock still see either the old or the new file
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *FileStore) read() (*State, error) {
+	state := newState()
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("%s: %v", s.path, err)
+	}
+	if state.Members == nil {
+		state.Members = map[string]*Member{}
+	}
+	if state.Leases == nil {
+		state.Leases = map[string]*Lease{}
+	}
+	return state, nil
+}
+
+func (s *FileStore) Close() error {
+	return s.lock.Close()
+}
@@ -0,0 +1,347 @@
+package cluster
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	nonceSize    = 32
+	maxFrameSize = 64 * 1024
+	dialTimeout  = 5 * time.Second
+	writeTimeout = 5 * time.Second
+	// a node that could not be reached is not dialed again for this long;
+	// packets for it are dropped meanwhile
+	redialDelay = 5 * time.Second
+	// a sender without packets for this long stops and closes its connection
+	idleTimeout = time.Minute
+	queueSize   = 256
+)
+
+// Link carries tunnel packets between nodes. Every node dials the others to
+// send and accepts their connections to receive. Both sides contribute a
+// random nonce; the keys of a connection are derived from them and the
+// cluster key, and every frame is sealed with AES-GCM.
+type Link struct {
+	node     string
+	key      []byte
+	listener net.Listener
+	deliver  func(from string, packet []byte)
+
+	mu      sync.Mutex
+	senders map[string]*sender
+	closed  bool
+}
+
+// sender owns the connection to one node. Packets wait in its queue so a slow
+// or unreachable node never blocks the caller of Send.
+type sender struct {
+	node  string
+	addr  string
+	queue chan []byte
+	stop  chan struct{}
+}
+
+// Listen accepts connections from other nodes on addr and passes the packets
+// they send to deliver.
+func Listen(addr, node string, key []byte, deliver func(from string, packet []byte)) (*Link, error) {
+	if len(key) != 32 {
+		return nil, errors.New("cluster key must be 32 bytes")
+	}
+	if node == "" || len(node) > 255 {
+		return nil, fmt.Errorf("invalid node name %q", node)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	link := &Link{
+		node:     node,
+		key:      key,
+		listener: listener,
+		deliver:  deliver,
+		senders:  map[string]*sender{},
+	}
+	go link.accept()
+	return link, nil
+}
+
+func (l *Link) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+func (l *Link) accept() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return
+		}
+		go l.receive(conn)
+	}
+}
+
+func (l *Link) receive(conn net.Conn) {
+	defer conn.Close()
+	_, recv, peer, err := l.handshake(conn, false)
+	if err != nil {
+		logrus.Warnf("cluster link from %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	logrus.Infof("cluster link from node %s (%s)", peer, conn.RemoteAddr())
+	for {
+		packet, err := readFrame(conn, recv)
+		if err != nil {
+			if err != io.EOF {
+				logrus.Warnf("cluster link from node %s: %v", peer, err)
+			}
+			return
+		}
+		l.deliver(peer, packet)
+	}
+}
+
+// Send queues packet for node, which is connected at addr. It never blocks;
+// the packet is dropped if the queue of that node is full.
+func (l *Link) Send(node, addr string, packet []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return errors.New("cluster link is closed")
+	}
+	s, ok := l.senders[node]
+	if ok && s.addr != addr {
+		close(s.stop)
+		ok = false
+	}
+	if !ok {
+		s = &sender{node: node, addr: addr, queue: make(chan []byte, queueSize), stop: make(chan struct{})}
+		l.senders[node] = s
+		go l.run(s)
+	}
+	select {
+	case s.queue <- append([]byte(nil), packet...):
+		return nil
+	default:
+		return fmt.Errorf("queue to node %s is full", node)
+	}
+}
+
+// Queued returns how many packets wait in the queues of all nodes.
+func (l *Link) Queued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	queued := 0
+	for _, s := range l.senders {
+		queued += len(s.queue)
+	}
+	return queued
+}
+
+// run writes the packets queued for one node, connecting when needed.
+func (l *Link) run(s *sender) {
+	var conn net.Conn
+	var seal *sealer
+	var failed time.Time
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	ticker := time.NewTicker(idleTimeout)
+	defer ticker.Stop()
+	lastUsed := time.Now()
+	for {
+		var packet []byte
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if time.Since(lastUsed) < idleTimeout {
+				continue
+			}
+			l.mu.Lock()
+			// Send queues under the lock, so nothing arrives after this check
+			if len(s.queue) == 0 {
+				if l.senders[s.node] == s {
+					delete(l.senders, s.node)
+				}
+				l.mu.Unlock()
+				return
+			}
+			l.mu.Unlock()
+			continue
+		case packet = <-s.queue:
+		}
+		lastUsed = time.Now()
+		if conn == nil {
+			if time.Since(failed) < redialDelay {
+				continue
+			}
+			var err error
+			if conn, seal, err = l.dial(s.node, s.addr); err != nil {
+				logrus.Warnf("cluster link to node %s failed: %v", s.node, err)
+				failed = time.Now()
+				continue
+			}
+		}
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := writeFrame(conn, seal, packet); err != nil {
+			logrus.Warnf("cluster link to node %s: %v", s.node, err)
+			conn.Close()
+			conn = nil
+		}
+	}
+}
+
+func (l *Link) dial(node, addr string) (net.Conn, *sealer, error) {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	send, _, peer, err := l.handshake(conn, true)
+	if err == nil && peer != node {
+		err = fmt.Errorf("%s is node %s, expected %s", addr, peer, node)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	// nothing is read on outgoing links; this notices when they close so the
+	// next packet reconnects
+	go func() {
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}()
+	logrus.Infof("cluster link to node %s (%s)", node, addr)
+	return conn, send, nil
+}
+
+// handshake exchanges nonces and node names, derives the keys of both
+// directions and proves that the other side knows the cluster key.
+func (l *Link) handshake(conn net.Conn, dialer bool) (send, recv *sealer, peer string, err error) {
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	defer conn.SetDeadline(time.Time{})
+	hello := make([]byte, nonceSize, nonceSize+1+len(l.node))
+	if _, err := rand.Read(hello); err != nil {
+		return nil, nil, "", err
+	}
+	hello = append(append(hello, byte(len(l.node))), l.node...)
+	if _, err := conn.Write(hello); err != nil {
+		return nil, nil, "", err
+	}
+	peerHello := make([]byte, nonceSize+1)
+	if _, err := io.ReadFull(conn, peerHello); err != nil {
+		return nil, nil, "", err
+	}
+	name := make([]byte, peerHello[nonceSize])
+	if _, err := io.ReadFull(conn, name); err != nil {
+		return nil, nil, "", err
+	}
+	peerHello = append(peerHello, name...)
+	dialerHello, listenerHello := hello, peerHello
+	if !dialer {
+		dialerHello, listenerHello = peerHello, hello
+	}
+	dialerKey := l.deriveKey("dialer", dialerHello, listenerHello)
+	listenerKey := l.deriveKey("listener", dialerHello, listenerHello)
+	if !dialer {
+		dialerKey, listenerKey = listenerKey, dialerKey
+	}
+	if send, err = newSealer(dialerKey); err != nil {
+		return nil, nil, "", err
+	}
+	if recv, err = newSealer(listenerKey); err != nil {
+		return nil, nil, "", err
+	}
+	if err := writeFrame(conn, send, []byte(l.node)); err != nil {
+		return nil, nil, "", err
+	}
+	confirm, err := readFrame(conn, recv)
+	if err != nil || string(confirm) != string(name) {
+		return nil, nil, "", errors.New("cluster key mismatch")
+	}
+	return send, recv, string(name), nil
+}
+
+func (l *Link) deriveKey(label string, dialerHello, listenerHello []byte) []byte {
+	mac := hmac.New(sha256.New, l.key)
+	mac.Write([]byte("govpn cluster " + label))
+	mac.Write(dialerHello)
+	mac.Write(listenerHello)
+	return mac.Sum(nil)
+}
+
+func (l *Link) Close() error {
+	err := l.listener.Close()
+	l.mu.Lock()
+	l.closed = true
+	for node, s := range l.senders {
+		close(s.stop)
+		delete(l.senders, node)
+	}
+	l.mu.Unlock()
+	return err
+}
+
+// sealer encrypts or decrypts one direction of a connection; the nonce is a
+// frame counter, so replayed or reordered frames fail to open.
+type sealer struct {
+	aead    cipher.AEAD
+	counter uint64
+}
+
+func newSealer(key []byte) (*sealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead}, nil
+}
+
+func (s *sealer) nonce() []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], s.counter)
+	s.counter++
+	return nonce
+}
+
+func writeFrame(w io.Writer, s *sealer, data []byte) error {
+	sealed := s.aead.Seal(make([]byte, 4, 4+len(data)+s.aead.Overhead()), s.nonce(), data, nil)
+	binary.BigEndian.PutUint32(sealed, uint32(len(sealed)-4))
+	_, err := w.Write(sealed)
+	return err
+}
+
+func readFrame(r io.Reader, s *sealer) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length > maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes is too large", length)
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		return nil, err
+	}
+	data, err := s.aead.Open(nil, s.nonce(), sealed, nil)
+	if err != nil {
+		return nil, errors.New("frame failed authentication")
+	}
+	return data, nil
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package cluster
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoLocking = errors.New("the file store is not supported on Windows")
+
+func lockFile(f *os.File, exclusive bool) error {
+	return errNoLocking
+}
+
+func unlockFile(f *os.File) error {
+	return errNoLocking
+}
@@ -0,0 +1,161 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+	"vpn/config"
+)
+
+const (
+	HeartbeatInterval = 5 * time.Second
+	// MemberTTL is how long a node counts as alive after its last heartbeat.
+	MemberTTL = 3 * HeartbeatInterval
+)
+
+// Member is a server node of the cluster.
+type Member struct {
+	Name    string    `json:"name"`
+	Addr    string    `json:"addr"`
+	Expires time.Time `json:"expires"`
+}
+
+// Lease reserves a tunnel IP for a session on one node. The nodes renew the
+// leases of their live sessions; a lease outlives its session by the session
+// TTL so the client can resume on any node with its ticket.
+type Lease struct {
+	IP      string    `json:"ip"`
+	IP6     string    `json:"ip6,omitempty"`
+	Peer    string    `json:"peer,omitempty"`
+	Node    string    `json:"node"`
+	Ticket  string    `json:"ticket,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// State is everything the nodes share.
+type State struct {
+	Members map[string]*Member `json:"members"`
+	Leases  map[string]*Lease  `json:"leases"`
+	// Peers replaces the peers of every node once set; PeersRevision counts
+	// the changes.
+	Peers         []config.Peer `json:"peers,omitempty"`
+	PeersRevision uint64        `json:"peers_revision,omitempty"`
+}
+
+// Store keeps the shared state. Implementations must apply Update atomically
+// across all nodes; the file store locks a file on a shared volume, others
+// may use a database transaction or a compare-and-swap.
+type Store interface {
+	Load() (*State, error)
+	// Update applies fn to the current state and saves the result unless fn
+	// fails.
+	Update(fn func(*State) error) error
+	Close() error
+}
+
+func newState() *State {
+	return &State{
+		Members: map[string]*Member{},
+		Leases:  map[string]*Lease{},
+	}
+}
+
+// Expire drops members and leases that were not renewed in time.
+func (s *State) Expire(now time.Time) {
+	for name, member := range s.Members {
+		if now.After(member.Expires) {
+			delete(s.Members, name)
+		}
+	}
+	for ip, lease := range s.Leases {
+		if now.After(lease.Expires) {
+			delete(s.Leases, ip)
+		}
+	}
+}
+
+// Allocate returns ip if it is free for a session of peer, or if that peer
+// resumes its session there with ticket. Otherwise it returns the first
+// address of subnet that is neither leased nor reserved, or "" if there is
+// none.
+func (s *State) Allocate(ip, ticket, peer string, subnet *net.IPNet, reserved map[string]bool, now time.Time) string {
+	base := subnet.IP.To4()
+	if base == nil {
+		return ""
+	}
+	ones, bits := subnet.Mask.Size()
+	first := binary.BigEndian.Uint32(base)
+	size := uint32(1) << uint(bits-ones)
+	// the network and broadcast addresses are skipped
+	if parsed := net.ParseIP(ip).To4(); parsed != nil && subnet.Contains(parsed) && !reserved[ip] {
+		if offset := binary.BigEndian.Uint32(parsed) - first; offset > 0 && offset+1 < size && s.available(ip, ticket, peer, now) {
+			return ip
+		}
+	}
+	for offset := uint32(1); offset+1 < size; offset++ {
+		candidate := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(candidate, first+offset)
+		if addr := candidate.String(); !reserved[addr] && s.available(addr, "", "", now) {
+			return addr
+		}
+	}
+	return ""
+}
+
+func (s *State) available(ip, ticket, peer string, now time.Time) bool {
+	existing, ok := s.Leases[ip]
+	if !ok || now.After(existing.Expires) {
+		return true
+	}
+	return ticket != "" && existing.Ticket == ticket && existing.Peer == peer
+}
+
+// Acquire gives lease.IP to lease.Node unless another node holds a live lease
+// for it. A client resuming with the ticket of that lease takes it over.
+// Conflicts between sessions of the same node are left to the node.
+func (s *State) Acquire(lease Lease, ticket string, now time.Time) error {
+	if existing, ok := s.Leases[lease.IP]; ok && existing.Node != lease.Node && now.Before(existing.Expires) {
+		resuming := ticket != "" && existing.Ticket == ticket && existing.Peer == lease.Peer
+		if !resuming {
+			return fmt.Errorf("IP %s is leased on node %s", lease.IP, existing.Node)
+		}
+	}
+	if lease.IP6 != "" {
+		for _, existing := range s.Leases {
+			if existing.IP6 == lease.IP6 && existing.IP != lease.IP && now.Before(existing.Expires) {
+				return fmt.Errorf("IPv6 address %s is leased to %s on node %s", lease.IP6, existing.IP, existing.Node)
+			}
+		}
+	}
+	s.Leases[lease.IP] = &lease
+	return nil
+}
+
+// Release drops the lease of ip if node still holds it for the session with
+// ticket.
+func (s *State) Release(ip, node, ticket string) {
+	if lease, ok := s.Leases[ip]; ok && lease.Node == node && lease.Ticket == ticket {
+		delete(s.Leases, ip)
+	}
+}
+
+// FindTicket returns the live lease issued with ticket.
+func (s *State) FindTicket(ticket string, now time.Time) *Lease {
+	for _, lease := range s.Leases {
+		if lease.Ticket == ticket && now.Before(lease.Expires) {
+			return lease
+		}
+	}
+	return nil
+}
+
+// Route returns the node that serves the tunnel address ip, IPv4 or IPv6.
+func (s *State) Route(ip string) *Member {
+	for _, lease := range s.Leases {
+		if lease.IP == ip || (lease.IP6 != "" && lease.IP6 == ip) {
+			return s.Members[lease.Node]
+		}
+	}
+	return nil
+}
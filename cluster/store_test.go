@@ -0,0 +1,118 @@
+package cluster
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func testState() *State {
+	state := newState()
+	state.Leases["10.0.0.2"] = &Lease{IP: "10.0.0.2", Peer: "alice", Node: "a", Ticket: "t1", Expires: now.Add(time.Minute)}
+	state.Leases["10.0.0.3"] = &Lease{IP: "10.0.0.3", Node: "a", Ticket: "t2", Expires: now.Add(-time.Minute)}
+	state.Leases["10.0.0.5"] = &Lease{IP: "10.0.0.5", IP6: "fd00::5", Node: "a", Expires: now.Add(time.Minute)}
+	return state
+}
+
+func TestAllocate(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/29")
+	_, full, _ := net.ParseCIDR("10.0.0.0/30")
+	reserved := map[string]bool{"10.0.0.1": true}
+	tests := []struct {
+		name             string
+		ip, ticket, peer string
+		subnet           *net.IPNet
+		want             string
+	}{
+		{"free", "10.0.0.4", "", "", subnet, "10.0.0.4"},
+		{"none requested", "", "", "", subnet, "10.0.0.3"},
+		{"expired lease", "10.0.0.3", "", "", subnet, "10.0.0.3"},
+		{"leased", "10.0.0.2", "", "", subnet, "10.0.0.3"},
+		{"resumed", "10.0.0.2", "t1", "alice", subnet, "10.0.0.2"},
+		{"ticket of another peer", "10.0.0.2", "t1", "bob", subnet, "10.0.0.3"},
+		{"reserved", "10.0.0.1", "", "", subnet, "10.0.0.3"},
+		{"network address", "10.0.0.0", "", "", subnet, "10.0.0.3"},
+		{"broadcast address", "10.0.0.7", "", "", subnet, "10.0.0.3"},
+		{"outside the subnet", "10.0.1.4", "", "", subnet, "10.0.0.3"},
+		{"invalid", "bogus", "", "", subnet, "10.0.0.3"},
+		{"subnet full", "", "", "", full, ""},
+	}
+	for _, test := range tests {
+		got := testState().Allocate(test.ip, test.ticket, test.peer, test.subnet, reserved, now)
+		if got != test.want {
+			t.Errorf("%s: Allocate(%q) = %q, want %q", test.name, test.ip, got, test.want)
+		}
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	tests := []struct {
+		name   string
+		lease  Lease
+		ticket string
+		at     time.Time
+		ok     bool
+	}{
+		{"free", Lease{IP: "10.0.0.4", Node: "b"}, "", now, true},
+		{"leased on another node", Lease{IP: "10.0.0.2", Node: "b"}, "", now, false},
+		{"resumed on another node", Lease{IP: "10.0.0.2", Peer: "alice", Node: "b"}, "t1", now, true},
+		{"ticket of another peer", Lease{IP: "10.0.0.2", Peer: "bob", Node: "b"}, "t1", now, false},
+		{"same node", Lease{IP: "10.0.0.2", Node: "a"}, "", now, true},
+		{"expired lease", Lease{IP: "10.0.0.3", Node: "b"}, "", now, true},
+		{"lease expired since", Lease{IP: "10.0.0.2", Node: "b"}, "", now.Add(time.Hour), true},
+		{"IPv6 leased", Lease{IP: "10.0.0.4", IP6: "fd00::5", Node: "b"}, "", now, false},
+		{"IPv6 of the same lease", Lease{IP: "10.0.0.5", IP6: "fd00::5", Node: "a"}, "", now, true},
+	}
+	for _, test := range tests {
+		state := testState()
+		err := state.Acquire(test.lease, test.ticket, test.at)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: Acquire = %v, want ok %v", test.name, err, test.ok)
+			continue
+		}
+		if got := state.Leases[test.lease.IP]; err == nil && !reflect.DeepEqual(*got, test.lease) {
+			t.Errorf("%s: lease is %+v, want %+v", test.name, got, test.lease)
+		}
+	}
+}
+
+func TestExpire(t *testing.T) {
+	tests := []struct {
+		at      time.Time
+		members []string
+		leases  []string
+	}{
+		{now.Add(-2 * time.Minute), []string{"a", "b"}, []string{"10.0.0.2", "10.0.0.3", "10.0.0.5"}},
+		{now, []string{"a"}, []string{"10.0.0.2", "10.0.0.5"}},
+		{now.Add(time.Hour), nil, nil},
+	}
+	for _, test := range tests {
+		state := testState()
+		state.Members["a"] = &Member{Name: "a", Expires: now.Add(MemberTTL)}
+		state.Members["b"] = &Member{Name: "b", Expires: now.Add(-time.Second)}
+		state.Expire(test.at)
+		members, leases := keys(state)
+		if !reflect.DeepEqual(members, test.members) {
+			t.Errorf("Expire(%v) kept members %v, want %v", test.at, members, test.members)
+		}
+		if !reflect.DeepEqual(leases, test.leases) {
+			t.Errorf("Expire(%v) kept leases %v, want %v", test.at, leases, test.leases)
+		}
+	}
+}
+
+func keys(state *State) (members, leases []string) {
+	for name := range state.Members {
+		members = append(members, name)
+	}
+	for ip := range state.Leases {
+		leases = append(leases, ip)
+	}
+	sort.Strings(members)
+	sort.Strings(leases)
+	return members, leases
+}
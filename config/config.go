@@ -1,17 +1,16 @@
 package config
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"time"
 )
 
 type Config struct {
-	Mode string // "server" "client"
-	Log  string // "debug" "info" "warn" "error"
-	MTU  int
+	Mode    string // "server" "client"
+	Profile string
+	Log     string // "debug" "info" "warn" "error"
+	MTU     int
 
-	ServerAddr string
+	Servers    []string // tried in order of measured latency
 	ListenAddr string
 	TunName    string
 
@@ -20,31 +19,113 @@ type Config struct {
 	VPNSubnet string
 	DNS       []string
 
-	TLSCert   string
-	TLSKey    string
-	SharedKey []byte
+	ServerIP6  string
+	ClientIP6  string
+	VPNSubnet6 string
+	NAT6       string // "masquerade", "none" or a prefix for NPTv6
+
+	TLSCert    string
+	TLSKey     string
+	TLSCertPEM string // inline client certificate from a profile
+	TLSKeyPEM  string
+	DataDir    string
+
+	SharedKey      Key
+	SharedKeyInput string // hex or base64, "-" reads stdin
+	SharedKeyFile  string
+
+	ControlSocket string
+	AdminAddr     string
+	AdminToken    string
+	MetricsAddr   string
+
+	RequireClientCert bool
+	Peers             []Peer
+
+	// cluster mode, enabled by ClusterStore
+	ClusterStore  string
+	ClusterNode   string
+	ClusterListen string
+	ClusterAddr   string // inter-node address other nodes dial
+	ClusterKey    string // hex or base64, separate from the shared key
+
+	// pushed to clients in generated profiles
+	PublicEndpoints []string
+	PushDNS         []string
+	PushRoutes      []string
+
+	TLSCA           string
+	ServerPin       string
+	TrustOnFirstUse bool
 
 	KeepAlive time.Duration
 	Timeout   time.Duration
+
+	IncludeRoutes []string
+	ExcludeRoutes []string
+	RouteTable    int
+	FwMark        int
+
+	DNSDomains   []string
+	DomainRules  []string
+	DNSUpstreams []string
+	DNSListen    string
+
+	KillSwitch    bool
+	AllowLAN      []string
+	BlockIPv6     bool
+	BlockDNSLeaks bool
+
+	SessionTTL        time.Duration
+	ReconnectDelay    time.Duration
+	ReconnectMaxDelay time.Duration
+
+	FallbackAddr     string
+	HandshakeTimeout time.Duration
+
+	Obfuscate         bool
+	ObfsMaxPadding    int
+	ObfsBucket        int
+	ObfsJitter        time.Duration
+	ObfsCoverInterval time.Duration
+
+	origins map[string]string
 }
 
 func newConfig() *Config {
-	key := make([]byte, 32)
-	rand.Read(key)
 	return &Config{
 		Mode:       "client",
 		Log:        "info",
 		MTU:        1400,
-		ServerAddr: "localhost:9999",
+		Servers:    []string{"localhost:9999"},
 		ListenAddr: ":9999",
 		TunName:    "tun",
 		ServerIP:   "10.0.0.1",
 		ClientIP:   "10.0.0.2",
 		VPNSubnet:  "10.0.0.0/24",
+		NAT6:       "masquerade",
 		DNS:        []string{"8.8.8.8", "8.8.4.4"},
-		SharedKey:  key,
+		DNSListen:  "127.0.0.1:53",
+		RouteTable: 51830,
+		FwMark:     51830,
+		DataDir:    "/var/lib/govpn",
 		KeepAlive:  30 * time.Second,
 		Timeout:    60 * time.Second,
+
+		ClusterListen: ":9998",
+
+		HandshakeTimeout: 10 * time.Second,
+
+		SessionTTL:        5 * time.Minute,
+		ReconnectDelay:    time.Second,
+		ReconnectMaxDelay: time.Minute,
+
+		BlockIPv6:       true,
+		BlockDNSLeaks:   true,
+		TrustOnFirstUse: true,
+
+		ObfsMaxPadding: 256,
+		ObfsBucket:     128,
 	}
 }
 
@@ -57,10 +138,6 @@ func NewServerConfig() *Config {
 func NewClientConfig(serverAddr string) *Config {
 	cfg := newConfig()
 	cfg.Mode = "client"
-	cfg.ServerAddr = serverAddr
+	cfg.Servers = []string{serverAddr}
 	return cfg
 }
-
-func (c *Config) KeyString() string {
-	return hex.EncodeToString(c.SharedKey)
-}
@@ -0,0 +1,304 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix prefixes the environment variable of every setting: "dns-upstream"
+// is read from GOVPN_DNS_UPSTREAM.
+const EnvPrefix = "GOVPN_"
+
+// setting maps a file key, environment variable and flag of the same name
+// onto a Config field.
+type setting struct {
+	key   string
+	field func(c *Config) interface{}
+}
+
+var serverSettings = []setting{
+	{"listen", func(c *Config) interface{} { return &c.ListenAddr }},
+	{"ip", func(c *Config) interface{} { return &c.ServerIP }},
+	{"subnet", func(c *Config) interface{} { return &c.VPNSubnet }},
+	{"ip6", func(c *Config) interface{} { return &c.ServerIP6 }},
+	{"subnet6", func(c *Config) interface{} { return &c.VPNSubnet6 }},
+	{"nat6", func(c *Config) interface{} { return &c.NAT6 }},
+	{"mtu", func(c *Config) interface{} { return &c.MTU }},
+	{"log", func(c *Config) interface{} { return &c.Log }},
+	{"timeout", func(c *Config) interface{} { return &c.Timeout }},
+	{"obfs", func(c *Config) interface{} { return &c.Obfuscate }},
+	{"cert", func(c *Config) interface{} { return &c.TLSCert }},
+	{"tls-key", func(c *Config) interface{} { return &c.TLSKey }},
+	{"data-dir", func(c *Config) interface{} { return &c.DataDir }},
+	{"fallback", func(c *Config) interface{} { return &c.FallbackAddr }},
+	{"mtls", func(c *Config) interface{} { return &c.RequireClientCert }},
+	{"admin", func(c *Config) interface{} { return &c.AdminAddr }},
+	{"admin-token", func(c *Config) interface{} { return &c.AdminToken }},
+	{"metrics", func(c *Config) interface{} { return &c.MetricsAddr }},
+	{"key", func(c *Config) interface{} { return &c.SharedKeyInput }},
+	{"key-file", func(c *Config) interface{} { return &c.SharedKeyFile }},
+	{"endpoint", func(c *Config) interface{} { return &c.PublicEndpoints }},
+	{"push-dns", func(c *Config) interface{} { return &c.PushDNS }},
+	{"push-routes", func(c *Config) interface{} { return &c.PushRoutes }},
+	{"cluster-store", func(c *Config) interface{} { return &c.ClusterStore }},
+	{"cluster-node", func(c *Config) interface{} { return &c.ClusterNode }},
+	{"cluster-listen", func(c *Config) interface{} { return &c.ClusterListen }},
+	{"cluster-addr", func(c *Config) interface{} { return &c.ClusterAddr }},
+	{"cluster-key", func(c *Config) interface{} { return &c.ClusterKey }},
+}
+
+var clientSettings = []setting{
+	{"server", func(c *Config) interface{} { return &c.Servers }},
+	{"ip", func(c *Config) interface{} { return &c.ClientIP }},
+	{"ip6", func(c *Config) interface{} { return &c.ClientIP6 }},
+	{"dns", func(c *Config) interface{} { return &c.DNS }},
+	{"mtu", func(c *Config) interface{} { return &c.MTU }},
+	{"log", func(c *Config) interface{} { return &c.Log }},
+	{"key", func(c *Config) interface{} { return &c.SharedKeyInput }},
+	{"key-file", func(c *Config) interface{} { return &c.SharedKeyFile }},
+	{"keepalive", func(c *Config) interface{} { return &c.KeepAlive }},
+	{"keepalive-timeout", func(c *Config) interface{} { return &c.Timeout }},
+	{"reconnect-delay", func(c *Config) interface{} { return &c.ReconnectDelay }},
+	{"reconnect-max-delay", func(c *Config) interface{} { return &c.ReconnectMaxDelay }},
+	{"control", func(c *Config) interface{} { return &c.ControlSocket }},
+	{"metrics", func(c *Config) interface{} { return &c.MetricsAddr }},
+	{"ca", func(c *Config) interface{} { return &c.TLSCA }},
+	{"pin", func(c *Config) interface{} { return &c.ServerPin }},
+	{"tofu", func(c *Config) interface{} { return &c.TrustOnFirstUse }},
+	{"cert", func(c *Config) interface{} { return &c.TLSCert }},
+	{"tls-key", func(c *Config) interface{} { return &c.TLSKey }},
+	{"cert-pem", func(c *Config) interface{} { return &c.TLSCertPEM }},
+	{"tls-key-pem", func(c *Config) interface{} { return &c.TLSKeyPEM }},
+	{"data-dir", func(c *Config) interface{} { return &c.DataDir }},
+	{"include", func(c *Config) interface{} { return &c.IncludeRoutes }},
+	{"exclude", func(c *Config) interface{} { return &c.ExcludeRoutes }},
+	{"dns-domains", func(c *Config) interface{} { return &c.DNSDomains }},
+	{"table", func(c *Config) interface{} { return &c.RouteTable }},
+	{"fwmark", func(c *Config) interface{} { return &c.FwMark }},
+	{"domains", func(c *Config) interface{} { return &c.DomainRules }},
+	{"dns-upstream", func(c *Config) interface{} { return &c.DNSUpstreams }},
+	{"dns-listen", func(c *Config) interface{} { return &c.DNSListen }},
+	{"killswitch", func(c *Config) interface{} { return &c.KillSwitch }},
+	{"allow-lan", func(c *Config) interface{} { return &c.AllowLAN }},
+	{"block-ipv6", func(c *Config) interface{} { return &c.BlockIPv6 }},
+	{"block-dns-leaks", func(c *Config) interface{} { return &c.BlockDNSLeaks }},
+	{"obfs", func(c *Config) interface{} { return &c.Obfuscate }},
+	{"obfs-padding", func(c *Config) interface{} { return &c.ObfsMaxPadding }},
+	{"obfs-bucket", func(c *Config) interface{} { return &c.ObfsBucket }},
+	{"obfs-jitter", func(c *Config) interface{} { return &c.ObfsJitter }},
+	{"obfs-cover", func(c *Config) interface{} { return &c.ObfsCoverInterval }},
+}
+
+func (c *Config) settings() []setting {
+	if c.Mode == "server" {
+		return serverSettings
+	}
+	return clientSettings
+}
+
+func (c *Config) lookup(key string) (interface{}, bool) {
+	for _, s := range c.settings() {
+		if s.key == key {
+			return s.field(c), true
+		}
+	}
+	return nil, false
+}
+
+// Origin tells where a setting was last set: "file:line", "$GOVPN_X" or
+// "flag -x". It is empty for defaults.
+func (c *Config) Origin(key string) string {
+	return c.origins[key]
+}
+
+func (c *Config) setOrigin(key, origin string) {
+	if c.origins == nil {
+		c.origins = map[string]string{}
+	}
+	c.origins[key] = origin
+}
+
+// Set parses value into the setting key. Lists are comma separated.
+func (c *Config) Set(key, value, origin string) error {
+	var values []string
+	if value != "" {
+		values = strings.Split(value, ",")
+	}
+	return c.set(key, value, values, origin)
+}
+
+func (c *Config) set(key, value string, values []string, origin string) error {
+	field, ok := c.lookup(key)
+	if !ok {
+		return &SettingError{Origin: origin, Key: key, Msg: "unknown setting"}
+	}
+	var err error
+	switch field := field.(type) {
+	case *string:
+		*field = value
+	case *[]string:
+		*field = values
+	case *int:
+		*field, err = strconv.Atoi(value)
+	case *bool:
+		*field, err = strconv.ParseBool(value)
+	case *time.Duration:
+		*field, err = time.ParseDuration(value)
+	}
+	if err != nil {
+		return &SettingError{Origin: origin, Key: key, Msg: fmt.Sprintf("invalid value %q", value)}
+	}
+	c.setOrigin(key, origin)
+	return nil
+}
+
+// LoadFile reads a YAML configuration file. Keys are the flag names; unknown
+// keys are rejected.
+func (c *Config) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s:%d: expected a mapping of settings", path, root.Line)
+	}
+	var errs Errors
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		origin := fmt.Sprintf("%s:%d", path, key.Line)
+		if key.Value == "peers" && c.Mode == "server" {
+			errs = append(errs, c.loadPeers(path, value)...)
+			continue
+		}
+		if err := c.setNode(key.Value, value, origin); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (c *Config) setNode(key string, node *yaml.Node, origin string) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		value := node.Value
+		if node.Tag == "!!null" {
+			value = ""
+		}
+		return c.Set(key, value, origin)
+	case yaml.SequenceNode:
+		field, ok := c.lookup(key)
+		if !ok {
+			return &SettingError{Origin: origin, Key: key, Msg: "unknown setting"}
+		}
+		if _, ok := field.(*[]string); !ok {
+			return &SettingError{Origin: origin, Key: key, Msg: "expected a single value"}
+		}
+		var values []string
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return &SettingError{Origin: origin, Key: key, Msg: "expected a list of values"}
+			}
+			values = append(values, item.Value)
+		}
+		return c.set(key, strings.Join(values, ","), values, origin)
+	default:
+		return &SettingError{Origin: origin, Key: key, Msg: "expected a value or a list"}
+	}
+}
+
+func (c *Config) loadPeers(path string, node *yaml.Node) Errors {
+	origin := fmt.Sprintf("%s:%d", path, node.Line)
+	if node.Kind != yaml.SequenceNode {
+		return Errors{&SettingError{Origin: origin, Key: "peers", Msg: "expected a list of peers"}}
+	}
+	var errs Errors
+	peers := make([]Peer, 0, len(node.Content))
+	for i, item := range node.Content {
+		key := fmt.Sprintf("peers[%d]", i)
+		origin := fmt.Sprintf("%s:%d", path, item.Line)
+		if item.Kind == yaml.MappingNode {
+			for j := 0; j < len(item.Content); j += 2 {
+				switch field := item.Content[j]; field.Value {
+				case "name", "ip", "disabled", "allow":
+				default:
+					errs = append(errs, &SettingError{
+						Origin: fmt.Sprintf("%s:%d", path, field.Line),
+						Key:    key,
+						Msg:    fmt.Sprintf("unknown field %q", field.Value),
+					})
+				}
+			}
+		}
+		var peer Peer
+		if err := item.Decode(&peer); err != nil {
+			errs = append(errs, &SettingError{Origin: origin, Key: key, Msg: err.Error()})
+			continue
+		}
+		c.setOrigin(key, origin)
+		peers = append(peers, peer)
+	}
+	c.Peers = peers
+	c.setOrigin("peers", origin)
+	return errs
+}
+
+// LoadEnv applies GOVPN_* environment variables.
+func (c *Config) LoadEnv() error {
+	var errs Errors
+	for _, s := range c.settings() {
+		name := EnvPrefix + strings.ToUpper(strings.ReplaceAll(s.key, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok {
+			if err := c.Set(s.key, value, "$"+name); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ApplyFlags applies the flags given on the command line that name a setting.
+// Flags left at their default do not override the file or environment.
+func (c *Config) ApplyFlags(fs *flag.FlagSet) error {
+	var errs Errors
+	fs.Visit(func(f *flag.Flag) {
+		if _, ok := c.lookup(f.Name); !ok {
+			return
+		}
+		if err := c.Set(f.Name, f.Value.String(), "flag -"+f.Name); err != nil {
+			errs = append(errs, err)
+		}
+	})
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Load applies a configuration file, if any, and the environment.
+func (c *Config) Load(path string) error {
+	if path != "" {
+		if err := c.LoadFile(path); err != nil {
+			return err
+		}
+	}
+	return c.LoadEnv()
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const KeySize = 32
+
+var ErrNoKey = errors.New("no shared key configured")
+
+// Key is the shared secret. It never prints itself, so a Config can be
+// logged without leaking it.
+type Key []byte
+
+func (k Key) String() string {
+	return "[redacted]"
+}
+
+// Fingerprint identifies a key in logs without revealing it.
+func (k Key) Fingerprint() string {
+	sum := sha256.Sum256(k)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (k Key) Hex() string {
+	return hex.EncodeToString(k)
+}
+
+func (k Key) Base64() string {
+	return base64.StdEncoding.EncodeToString(k)
+}
+
+func GenerateKey() (Key, error) {
+	key := make(Key, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ParseKey accepts a key in hex or standard base64.
+func ParseKey(s string) (Key, error) {
+	s = strings.TrimSpace(s)
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		if key, err = base64.StdEncoding.DecodeString(s); err != nil {
+			return nil, errors.New("key is neither hex nor base64")
+		}
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("invalid key size: %d must be %d bytes", len(key), KeySize)
+	}
+	return key, nil
+}
+
+// ReadKey reads a key from the first line of r.
+func ReadKey(r io.Reader) (Key, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return ParseKey(line)
+}
+
+// LoadKeyFile reads a key file. On Unix the file must not be accessible to
+// group or others.
+func LoadKeyFile(path string) (Key, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s: permissions %04o are too open, run chmod 600 %s", path, info.Mode().Perm(), path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	key, err := ReadKey(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return key, nil
+}
+
+// SaveKeyFile writes key in hex to a new file readable only by its owner.
+func SaveKeyFile(path string, key Key) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, key.Hex()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// KeyFile is the default shared key file of the server.
+func KeyFile(dataDir string) string {
+	return filepath.Join(dataDir, "shared.key")
+}
+
+// ResolveKey sets SharedKey from, in order, the "key" setting ("-" reads
+// stdin), the "key-file" setting or, on the server, <data-dir>/shared.key,
+// which is generated on first start. It returns the source used. Without any
+// source a client gets ErrNoKey.
+func (c *Config) ResolveKey(stdin io.Reader) (string, error) {
+	var err error
+	switch {
+	case c.SharedKeyInput == "-":
+		c.SharedKey, err = ReadKey(stdin)
+		return "stdin", err
+	case c.SharedKeyInput != "":
+		c.SharedKey, err = ParseKey(c.SharedKeyInput)
+		return c.Origin("key"), err
+	case c.SharedKeyFile != "":
+		c.SharedKey, err = LoadKeyFile(c.SharedKeyFile)
+		return c.SharedKeyFile, err
+	case c.Mode == "server":
+		path := KeyFile(c.DataDir)
+		c.SharedKey, err = LoadKeyFile(path)
+		if os.IsNotExist(err) {
+			if c.SharedKey, err = GenerateKey(); err != nil {
+				return path, err
+			}
+			return path + " (generated)", SaveKeyFile(path, c.SharedKey)
+		}
+		return path, err
+	}
+	return "", ErrNoKey
+}
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+type Peer struct {
+	Name     string   `json:"name" yaml:"name"`
+	IP       string   `json:"ip,omitempty" yaml:"ip"`
+	Disabled bool     `json:"disabled,omitempty" yaml:"disabled"`
+	Allow    []string `json:"allow,omitempty" yaml:"allow"` // reachable CIDRs, empty allows all
+}
+
+func PeersFile(dataDir string) string {
+	return filepath.Join(dataDir, "peers.json")
+}
+
+func LoadPeers(path string) ([]Peer, error) {
+	var peers []Peer
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return peers, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", path, err)
+	}
+	return peers, nil
+}
+
+func SavePeers(path string, peers []Peer) error {
+	data, err := json.MarshalIndent(peers, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func FindPeer(peers []Peer, name string) *Peer {
+	for i := range peers {
+		if peers[i].Name == name {
+			return &peers[i]
+		}
+	}
+	return nil
+}
+
+// MergePeers adds the peers of the configuration file that are not in
+// stored, the list kept up to date by the admin API and "ca issue".
+func MergePeers(file, stored []Peer) []Peer {
+	merged := append([]Peer{}, stored...)
+	for _, peer := range file {
+		if FindPeer(merged, peer.Name) == nil {
+			merged = append(merged, peer)
+		}
+	}
+	return merged
+}
+
+// ShadowedPeers names the peers of the configuration file that MergePeers
+// drops because stored has a different entry of the same name.
+func ShadowedPeers(file, stored []Peer) []string {
+	var names []string
+	for _, peer := range file {
+		if other := FindPeer(stored, peer.Name); other != nil && !reflect.DeepEqual(*other, peer) {
+			names = append(names, peer.Name)
+		}
+	}
+	return names
+}
+
+// CheckPeerIP reports why ip cannot be assigned to a new peer: it must be a
+// host address of subnet that is neither the server's nor another peer's.
+func CheckPeerIP(subnet, serverIP, ip string, peers []Peer) error {
+	_, network, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return err
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("invalid IP address %q", ip)
+	}
+	if !network.Contains(parsed) {
+		return fmt.Errorf("%s is outside %s", ip, network)
+	}
+	broadcast := make(net.IP, len(network.IP))
+	for i := range network.IP {
+		broadcast[i] = network.IP[i] | ^network.Mask[i]
+	}
+	if parsed.Equal(network.IP) || parsed.Equal(broadcast) {
+		return fmt.Errorf("%s is not a host address of %s", ip, network)
+	}
+	if ip == serverIP {
+		return fmt.Errorf("%s is the server's IP", ip)
+	}
+	for _, peer := range peers {
+		if peer.IP == ip {
+			return fmt.Errorf("IP %s is already assigned to %q", ip, peer.Name)
+		}
+	}
+	return nil
+}
+
+// AllocatePeerIP returns the lowest host address of subnet that is neither
+// the server's nor assigned to a peer.
+func AllocatePeerIP(subnet, serverIP string, peers []Peer) (string, error) {
+	_, network, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return "", err
+	}
+	network4 := network.IP.To4()
+	if network4 == nil {
+		return "", errors.New("peer IPs are allocated from an IPv4 subnet")
+	}
+	used := map[string]bool{serverIP: true}
+	for _, peer := range peers {
+		used[peer.IP] = true
+	}
+	ones, bits := network.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	base := uint32(network4[0])<<24 | uint32(network4[1])<<16 | uint32(network4[2])<<8 | uint32(network4[3])
+	// skip the network and broadcast addresses
+	for offset := uint32(1); offset+1 < size; offset++ {
+		n := base + offset
+		ip := net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n)).String()
+		if !used[ip] {
+			return ip, nil
+		}
+	}
+	return "", fmt.Errorf("no free address left in %s", subnet)
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAllocatePeerIP(t *testing.T) {
+	tests := []struct {
+		subnet, serverIP string
+		peers            []Peer
+		want             string
+	}{
+		{"10.0.0.0/24", "10.0.0.1", nil, "10.0.0.2"},
+		{"10.0.0.0/24", "10.0.0.2", nil, "10.0.0.1"},
+		{"10.0.0.0/24", "10.0.0.1", []Peer{{Name: "a", IP: "10.0.0.2"}, {Name: "b", IP: "10.0.0.4"}}, "10.0.0.3"},
+		{"10.0.0.0/30", "10.0.0.1", []Peer{{Name: "a", IP: "10.0.0.2"}}, ""},
+		{"fd00::/64", "fd00::1", nil, ""},
+		{"bogus", "10.0.0.1", nil, ""},
+	}
+	for _, test := range tests {
+		got, err := AllocatePeerIP(test.subnet, test.serverIP, test.peers)
+		if got != test.want || (err == nil) != (test.want != "") {
+			t.Errorf("AllocatePeerIP(%s, %s, %v) = %q, %v, want %q", test.subnet, test.serverIP, test.peers, got, err, test.want)
+		}
+	}
+}
+
+func TestCheckPeerIP(t *testing.T) {
+	peers := []Peer{{Name: "alice", IP: "10.0.0.2"}}
+	tests := []struct {
+		ip string
+		ok bool
+	}{
+		{"10.0.0.3", true},
+		{"10.0.0.254", true},
+		{"10.0.0.1", false},
+		{"10.0.0.2", false},
+		{"10.0.0.0", false},
+		{"10.0.0.255", false},
+		{"10.0.1.3", false},
+		{"bogus", false},
+	}
+	for _, test := range tests {
+		if err := CheckPeerIP("10.0.0.0/24", "10.0.0.1", test.ip, peers); (err == nil) != test.ok {
+			t.Errorf("CheckPeerIP(%q) = %v, want ok %v", test.ip, err, test.ok)
+		}
+	}
+}
+
+func TestMergePeers(t *testing.T) {
+	alice := Peer{Name: "alice", IP: "10.0.0.2"}
+	bob := Peer{Name: "bob", IP: "10.0.0.3"}
+	editedBob := Peer{Name: "bob", IP: "10.0.0.3", Allow: []string{"10.1.0.0/16"}}
+	carol := Peer{Name: "carol", IP: "10.0.0.4", Disabled: true}
+	tests := []struct {
+		name         string
+		file, stored []Peer
+		want         []Peer
+		shadowed     []string
+	}{
+		{"file only", []Peer{alice, bob}, nil, []Peer{alice, bob}, nil},
+		{"stored only", nil, []Peer{carol}, []Peer{carol}, nil},
+		{"disjoint", []Peer{alice}, []Peer{carol}, []Peer{carol, alice}, nil},
+		{"same entry", []Peer{alice, bob}, []Peer{bob}, []Peer{bob, alice}, nil},
+		{"stored wins", []Peer{alice, editedBob}, []Peer{bob, carol}, []Peer{bob, carol, alice}, []string{"bob"}},
+	}
+	for _, test := range tests {
+		if got := MergePeers(test.file, test.stored); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: MergePeers = %v, want %v", test.name, got, test.want)
+		}
+		if got := ShadowedPeers(test.file, test.stored); !reflect.DeepEqual(got, test.shadowed) {
+			t.Errorf("%s: ShadowedPeers = %v, want %v", test.name, got, test.shadowed)
+		}
+	}
+}
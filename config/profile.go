@@ -0,0 +1,268 @@
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const URIScheme = "govpn"
+
+var profileName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Profile holds what a client needs to reach one server. It is stored as a
+// client configuration file, so the YAML keys are the option names.
+type Profile struct {
+	Name    string    `json:"name" yaml:"-"`
+	Server  Endpoints `json:"server" yaml:"server"`
+	Key     string    `json:"key" yaml:"key"`
+	Pin     string    `json:"pin,omitempty" yaml:"pin,omitempty"`
+	IP      string    `json:"ip,omitempty" yaml:"ip,omitempty"`
+	IP6     string    `json:"ip6,omitempty" yaml:"ip6,omitempty"`
+	DNS     []string  `json:"dns,omitempty" yaml:"dns,omitempty"`
+	MTU     int       `json:"mtu,omitempty" yaml:"mtu,omitempty"`
+	Include []string  `json:"include,omitempty" yaml:"include,omitempty"`
+	Obfs    bool      `json:"obfs,omitempty" yaml:"obfs,omitempty"`
+	CertPEM string    `json:"cert_pem,omitempty" yaml:"cert-pem,omitempty"`
+	KeyPEM  string    `json:"tls_key_pem,omitempty" yaml:"tls-key-pem,omitempty"`
+}
+
+// Endpoints are server addresses. Like the "server" setting they are written
+// as a single value or a list.
+type Endpoints []string
+
+func (e Endpoints) String() string {
+	return strings.Join(e, ",")
+}
+
+func (e *Endpoints) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*e = strings.Split(node.Value, ",")
+		return nil
+	}
+	var values []string
+	if err := node.Decode(&values); err != nil {
+		return err
+	}
+	*e = values
+	return nil
+}
+
+func (e Endpoints) MarshalYAML() (interface{}, error) {
+	if len(e) == 1 {
+		return e[0], nil
+	}
+	return []string(e), nil
+}
+
+func ValidProfileName(name string) error {
+	if !profileName.MatchString(name) {
+		return fmt.Errorf("invalid profile name %q", name)
+	}
+	return nil
+}
+
+// URI encodes the profile as a single import string:
+// govpn://<base64url key>@host:port?ip=...&pin=...#name
+// Further server addresses go into the server parameter.
+func (p *Profile) URI() (string, error) {
+	if p.CertPEM != "" {
+		return "", errors.New("profiles with a client certificate only fit in a file")
+	}
+	if len(p.Server) == 0 {
+		return "", errors.New("profile has no server address")
+	}
+	key, err := ParseKey(p.Key)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{}
+	if len(p.Server) > 1 {
+		query.Set("server", p.Server[1:].String())
+	}
+	if p.IP != "" {
+		query.Set("ip", p.IP)
+	}
+	if p.IP6 != "" {
+		query.Set("ip6", p.IP6)
+	}
+	if p.Pin != "" {
+		query.Set("pin", p.Pin)
+	}
+	if len(p.DNS) > 0 {
+		query.Set("dns", strings.Join(p.DNS, ","))
+	}
+	if p.MTU != 0 {
+		query.Set("mtu", strconv.Itoa(p.MTU))
+	}
+	if len(p.Include) > 0 {
+		query.Set("include", strings.Join(p.Include, ","))
+	}
+	if p.Obfs {
+		query.Set("obfs", "1")
+	}
+	u := url.URL{
+		Scheme:   URIScheme,
+		User:     url.User(base64.RawURLEncoding.EncodeToString(key)),
+		Host:     p.Server[0],
+		RawQuery: query.Encode(),
+		Fragment: p.Name,
+	}
+	return u.String(), nil
+}
+
+func ParseURI(s string) (*Profile, error) {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != URIScheme {
+		return nil, fmt.Errorf("expected a %s:// URI", URIScheme)
+	}
+	if u.User == nil {
+		return nil, errors.New("URI has no key")
+	}
+	key, err := base64.RawURLEncoding.DecodeString(u.User.Username())
+	if err != nil || len(key) != KeySize {
+		return nil, errors.New("URI has an invalid key")
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("invalid server address %q", u.Host)
+	}
+	query := u.Query()
+	p := &Profile{
+		Name:   u.Fragment,
+		Server: Endpoints{u.Host},
+		Key:    Key(key).Hex(),
+		Pin:    query.Get("pin"),
+		IP:     query.Get("ip"),
+		IP6:    query.Get("ip6"),
+		Obfs:   query.Get("obfs") == "1",
+	}
+	if servers := query.Get("server"); servers != "" {
+		for _, server := range strings.Split(servers, ",") {
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				return nil, fmt.Errorf("invalid server address %q", server)
+			}
+			p.Server = append(p.Server, server)
+		}
+	}
+	if dns := query.Get("dns"); dns != "" {
+		p.DNS = strings.Split(dns, ",")
+	}
+	if include := query.Get("include"); include != "" {
+		p.Include = strings.Split(include, ",")
+	}
+	if mtu := query.Get("mtu"); mtu != "" {
+		if p.MTU, err = strconv.Atoi(mtu); err != nil {
+			return nil, fmt.Errorf("invalid MTU %q", mtu)
+		}
+	}
+	return p, nil
+}
+
+func ProfilesDir(dataDir string) string {
+	return filepath.Join(dataDir, "profiles")
+}
+
+func ProfilePath(dataDir, name string) string {
+	return filepath.Join(ProfilesDir(dataDir), name+".yaml")
+}
+
+// SaveProfile stores p as <data-dir>/profiles/<name>.yaml, readable only by
+// its owner since it contains the key.
+func SaveProfile(dataDir string, p *Profile) error {
+	if err := ValidProfileName(p.Name); err != nil {
+		return err
+	}
+	data, err := p.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(ProfilesDir(dataDir), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(ProfilePath(dataDir, p.Name), data, 0600)
+}
+
+func LoadProfile(dataDir, name string) (*Profile, error) {
+	if err := ValidProfileName(name); err != nil {
+		return nil, err
+	}
+	p, err := ReadProfile(ProfilePath(dataDir, name))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("profile %q not found", name)
+	}
+	return p, err
+}
+
+// ReadProfile reads a profile file, named after the file.
+func ReadProfile(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Profile{Name: strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))}
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return p, nil
+}
+
+// Marshal returns the profile file contents.
+func (p *Profile) Marshal() ([]byte, error) {
+	data, err := yaml.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("# govpn profile "+p.Name+"\n"), data...), nil
+}
+
+func RemoveProfile(dataDir, name string) error {
+	if err := ValidProfileName(name); err != nil {
+		return err
+	}
+	err := os.Remove(ProfilePath(dataDir, name))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("profile %q not found", name)
+	}
+	return err
+}
+
+func ListProfiles(dataDir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(ProfilesDir(dataDir), "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, strings.TrimSuffix(filepath.Base(file), ".yaml"))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// LoadProfileSettings applies a stored profile on top of the current settings.
+func (c *Config) LoadProfileSettings(name string) error {
+	if err := ValidProfileName(name); err != nil {
+		return err
+	}
+	path := ProfilePath(c.DataDir, name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return fmt.Errorf("profile %q not found", name)
+	}
+	if err := c.LoadFile(path); err != nil {
+		return err
+	}
+	c.Profile = name
+	return nil
+}
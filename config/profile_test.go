@@ -0,0 +1,75 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProfileURIRoundTrip(t *testing.T) {
+	key := strings.Repeat("ab", KeySize)
+	tests := []Profile{
+		{Server: Endpoints{"vpn.example.com:9999"}, Key: key},
+		{Name: "office", Server: Endpoints{"203.0.113.1:9999"}, Key: key, IP: "10.0.0.7"},
+		{
+			Name:    "home",
+			Server:  Endpoints{"vpn.example.com:9999", "[2001:db8::1]:9999", "backup.example.com:443"},
+			Key:     key,
+			Pin:     "sha256/AAAA+/==",
+			IP:      "10.0.0.8",
+			IP6:     "fd00::8",
+			DNS:     []string{"10.0.0.1", "1.1.1.1"},
+			MTU:     1380,
+			Include: []string{"10.1.0.0/16", "192.168.5.0/24"},
+			Obfs:    true,
+		},
+	}
+	for _, profile := range tests {
+		uri, err := profile.URI()
+		if err != nil {
+			t.Errorf("%+v: %v", profile, err)
+			continue
+		}
+		got, err := ParseURI(uri)
+		if err != nil {
+			t.Errorf("ParseURI(%s): %v", uri, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, profile) {
+			t.Errorf("ParseURI(%s) = %+v, want %+v", uri, *got, profile)
+		}
+	}
+}
+
+func TestProfileURIErrors(t *testing.T) {
+	key := strings.Repeat("ab", KeySize)
+	for _, profile := range []Profile{
+		{Key: key},
+		{Server: Endpoints{"vpn.example.com:9999"}, Key: "short"},
+		{Server: Endpoints{"vpn.example.com:9999"}, Key: key, CertPEM: "-----BEGIN CERTIFICATE-----"},
+	} {
+		if uri, err := profile.URI(); err == nil {
+			t.Errorf("%+v encoded as %s, want an error", profile, uri)
+		}
+	}
+}
+
+func TestParseURIErrors(t *testing.T) {
+	key := "q6urq6urq6urq6urq6urq6urq6urq6urq6urq6urq6s"
+	tests := []string{
+		"https://" + key + "@vpn.example.com:9999",
+		"govpn://vpn.example.com:9999",
+		"govpn://c2hvcnQ@vpn.example.com:9999",
+		"govpn://" + key + "@vpn.example.com",
+		"govpn://" + key + "@vpn.example.com:9999?server=backup.example.com",
+		"govpn://" + key + "@vpn.example.com:9999?mtu=big",
+	}
+	for _, uri := range tests {
+		if profile, err := ParseURI(uri); err == nil {
+			t.Errorf("ParseURI(%s) = %+v, want an error", uri, profile)
+		}
+	}
+	if _, err := ParseURI("govpn://" + key + "@vpn.example.com:9999"); err != nil {
+		t.Errorf("the valid base URI was rejected: %v", err)
+	}
+}
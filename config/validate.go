@@ -0,0 +1,260 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	MinMTU = 576
+	MaxMTU = 9000
+
+	// obfuscation bounds; the server clamps what clients propose to them
+	MaxObfsPadding = 1024
+	MaxObfsBucket  = 1024
+	MaxObfsJitter  = 100 * time.Millisecond
+	MinObfsCover   = 100 * time.Millisecond
+)
+
+// SettingError is a problem with one setting, reported where it was set.
+type SettingError struct {
+	Origin string
+	Key    string
+	Msg    string
+}
+
+func (e *SettingError) Error() string {
+	if e.Origin == "" {
+		return fmt.Sprintf("%s: %s (default)", e.Key, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Origin, e.Key, e.Msg)
+}
+
+type Errors []error
+
+func (errs Errors) Error() string {
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+type validator struct {
+	config *Config
+	errs   Errors
+}
+
+func (v *validator) fail(key, format string, args ...interface{}) {
+	v.errs = append(v.errs, &SettingError{Origin: v.config.Origin(key), Key: key, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) ip(key, value string) net.IP {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		v.fail(key, "invalid IP address %q", value)
+	}
+	return ip
+}
+
+func (v *validator) cidr(key, value string) *net.IPNet {
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		v.fail(key, "invalid CIDR %q", value)
+	}
+	return network
+}
+
+func (v *validator) cidrs(key string, values []string) {
+	for _, value := range values {
+		v.cidr(key, strings.TrimSpace(value))
+	}
+}
+
+func (v *validator) addr(key, value string) {
+	if value == "" {
+		return
+	}
+	if _, _, err := net.SplitHostPort(value); err != nil {
+		v.fail(key, "invalid address %q, expected host:port", value)
+	}
+}
+
+func (v *validator) addrs(key string, values []string) {
+	for _, value := range values {
+		v.addr(key, strings.TrimSpace(value))
+	}
+}
+
+func (v *validator) within(key, value string, network *net.IPNet) {
+	if ip := v.ip(key, value); ip != nil && network != nil && !network.Contains(ip) {
+		v.fail(key, "%s is outside %s", value, network)
+	}
+}
+
+// Validate checks the final configuration and reports every problem with
+// the file line, environment variable or flag that set it.
+func (c *Config) Validate() error {
+	v := &validator{config: c}
+	if c.MTU < MinMTU || c.MTU > MaxMTU {
+		v.fail("mtu", "must be between %d and %d", MinMTU, MaxMTU)
+	}
+	if c.SharedKeyInput != "" && c.SharedKeyInput != "-" {
+		if _, err := ParseKey(c.SharedKeyInput); err != nil {
+			v.fail("key", "%v", err)
+		}
+	}
+	if c.SharedKeyFile != "" {
+		if _, err := LoadKeyFile(c.SharedKeyFile); err != nil {
+			v.fail("key-file", "%v", err)
+		}
+	}
+	switch c.Log {
+	case "debug", "info", "warn", "warning", "error":
+	default:
+		v.fail("log", "unknown level %q", c.Log)
+	}
+	if c.Mode == "server" {
+		c.validateServer(v)
+	} else {
+		c.validateClient(v)
+	}
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
+
+func (c *Config) validateServer(v *validator) {
+	v.addr("listen", c.ListenAddr)
+	v.addr("admin", c.AdminAddr)
+	v.addr("metrics", c.MetricsAddr)
+	v.addr("fallback", c.FallbackAddr)
+	v.addrs("endpoint", c.PublicEndpoints)
+	for _, dns := range c.PushDNS {
+		v.ip("push-dns", strings.TrimSpace(dns))
+	}
+	v.cidrs("push-routes", c.PushRoutes)
+	subnet := v.cidr("subnet", c.VPNSubnet)
+	v.within("ip", c.ServerIP, subnet)
+	if c.VPNSubnet6 != "" {
+		subnet6 := v.cidr("subnet6", c.VPNSubnet6)
+		if c.ServerIP6 != "" {
+			v.within("ip6", c.ServerIP6, subnet6)
+		}
+		switch c.NAT6 {
+		case "masquerade", "none":
+		default:
+			v.cidr("nat6", c.NAT6)
+		}
+	}
+	if c.Timeout <= 0 {
+		v.fail("timeout", "must be positive")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		v.fail("cert", "cert and tls-key must be set together")
+	}
+	if c.ClusterStore != "" {
+		if c.TLSCert == "" || c.TLSKey == "" {
+			// clients pin the certificate of the first node they reach, so
+			// every node has to present one they also trust
+			v.fail("cert", "cert and tls-key are required with cluster-store, all nodes must share the certificate or its CA")
+		}
+		v.addr("cluster-listen", c.ClusterListen)
+		v.addr("cluster-addr", c.ClusterAddr)
+		if len(c.ClusterNode) > 255 {
+			v.fail("cluster-node", "must not be longer than 255 bytes")
+		}
+		if c.ClusterKey == "" {
+			v.fail("cluster-key", "is required with cluster-store")
+		} else if key, err := ParseKey(c.ClusterKey); err != nil {
+			v.fail("cluster-key", "%v", err)
+		} else if c.SharedKeyInput != "" && c.SharedKeyInput != "-" {
+			if shared, err := ParseKey(c.SharedKeyInput); err == nil && string(shared) == string(key) {
+				v.fail("cluster-key", "must differ from the shared key, which clients know")
+			}
+		}
+	}
+	names := map[string]bool{}
+	ips := map[string]string{}
+	for i, peer := range c.Peers {
+		key := fmt.Sprintf("peers[%d]", i)
+		switch {
+		case peer.Name == "":
+			v.fail(key, "name is required")
+		case names[peer.Name]:
+			v.fail(key, "duplicate peer %q", peer.Name)
+		}
+		names[peer.Name] = true
+		if peer.IP != "" {
+			v.within(key, peer.IP, subnet)
+			if other, ok := ips[peer.IP]; ok {
+				v.fail(key, "IP %s is already assigned to %q", peer.IP, other)
+			}
+			ips[peer.IP] = peer.Name
+		}
+		v.cidrs(key, peer.Allow)
+	}
+}
+
+func (c *Config) validateClient(v *validator) {
+	if len(c.Servers) == 0 {
+		v.fail("server", "at least one server address is required")
+	}
+	v.addrs("server", c.Servers)
+	v.addr("dns-listen", c.DNSListen)
+	v.addr("metrics", c.MetricsAddr)
+	if ip := v.ip("ip", c.ClientIP); ip != nil && ip.To4() == nil {
+		v.fail("ip", "%s is not an IPv4 address", c.ClientIP)
+	}
+	if c.ClientIP6 != "" {
+		v.ip("ip6", c.ClientIP6)
+	}
+	for _, dns := range c.DNS {
+		v.ip("dns", strings.TrimSpace(dns))
+	}
+	for _, dns := range c.DNSUpstreams {
+		v.ip("dns-upstream", strings.TrimSpace(dns))
+	}
+	v.cidrs("include", c.IncludeRoutes)
+	v.cidrs("exclude", c.ExcludeRoutes)
+	v.cidrs("allow-lan", c.AllowLAN)
+	if c.KeepAlive < time.Second {
+		v.fail("keepalive", "must be at least 1s")
+	}
+	if c.Timeout < 2*c.KeepAlive {
+		v.fail("keepalive-timeout", "must be at least twice the keepalive interval")
+	}
+	if c.ReconnectDelay <= 0 {
+		v.fail("reconnect-delay", "must be greater than 0")
+	}
+	if c.ReconnectMaxDelay < c.ReconnectDelay {
+		v.fail("reconnect-max-delay", "must be at least the reconnect delay")
+	}
+	if c.ObfsMaxPadding < 0 || c.ObfsMaxPadding > MaxObfsPadding {
+		v.fail("obfs-padding", "must be between 0 and %d", MaxObfsPadding)
+	}
+	if c.ObfsBucket < 1 || c.ObfsBucket > MaxObfsBucket {
+		v.fail("obfs-bucket", "must be between 1 and %d", MaxObfsBucket)
+	}
+	if c.ObfsJitter < 0 || c.ObfsJitter > MaxObfsJitter {
+		v.fail("obfs-jitter", "must be between 0 and %v", MaxObfsJitter)
+	}
+	if c.ObfsCoverInterval != 0 && c.ObfsCoverInterval < MinObfsCover {
+		v.fail("obfs-cover", "must be 0 or at least %v", MinObfsCover)
+	}
+	if c.ServerPin != "" && !strings.HasPrefix(c.ServerPin, "sha256/") {
+		v.fail("pin", "expected sha256/<base64>")
+	}
+	if c.TLSCA == "" && c.ServerPin == "" && !c.TrustOnFirstUse {
+		v.fail("tofu", "the server certificate must be verified, set ca or pin to turn it off")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		v.fail("cert", "cert and tls-key must be set together")
+	}
+	if (c.TLSCertPEM == "") != (c.TLSKeyPEM == "") {
+		v.fail("cert-pem", "cert-pem and tls-key-pem must be set together")
+	}
+}
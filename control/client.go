@@ -0,0 +1,66 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+type Client struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+	nextID  int
+}
+
+func Dial(path string) (*Client, error) {
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %v", path, err)
+	}
+	return &Client{
+		conn:    conn,
+		scanner: bufio.NewScanner(conn),
+	}, nil
+}
+
+// Call invokes method with params and decodes the result into result, which
+// may be nil.
+func (c *Client) Call(method string, params, result interface{}) error {
+	c.nextID++
+	request := Request{ID: c.nextID, Method: method}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		request.Params = data
+	}
+	c.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := json.NewEncoder(c.conn).Encode(request); err != nil {
+		return err
+	}
+	if !c.scanner.Scan() {
+		if err := c.scanner.Err(); err != nil {
+			return err
+		}
+		return errors.New("connection closed")
+	}
+	var response Response
+	if err := json.Unmarshal(c.scanner.Bytes(), &response); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
+	if result != nil && response.Result != nil {
+		return json.Unmarshal(response.Result, result)
+	}
+	return nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,25 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+const DefaultSocket = "/run/govpn.sock"
+
+var ErrPermission = errors.New("permission denied")
+
+// Request and Response are exchanged as one JSON object per line.
+type Request struct {
+	ID     int             `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type Response struct {
+	ID     int             `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+type HandlerFunc func(params json.RawMessage) (interface{}, error)
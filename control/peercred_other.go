@@ -0,0 +1,15 @@
+//go:build !linux
+
+package control
+
+import (
+	"errors"
+	"net"
+)
+
+// without SO_PEERCRED the socket is restricted to its owner instead
+const peerCredentialsSupported = false
+
+func peerUID(conn *net.UnixConn) (int, error) {
+	return -1, errors.New("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,168 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type method struct {
+	handler    HandlerFunc
+	privileged bool
+}
+
+// Server answers control requests on a Unix socket. Anyone who can open the
+// socket may call unprivileged methods; privileged ones need the peer to be
+// root or the user running the daemon.
+type Server struct {
+	path     string
+	listener net.Listener
+	methods  map[string]method
+	conns    map[net.Conn]struct{}
+	mu       sync.RWMutex
+	wg       sync.WaitGroup
+}
+
+func NewServer(path string) *Server {
+	return &Server{
+		path:    path,
+		methods: make(map[string]method),
+		conns:   make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *Server) Handle(name string, privileged bool, handler HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.methods[name] = method{handler: handler, privileged: privileged}
+}
+
+func (s *Server) Start() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	// a socket left by a crashed daemon blocks the listen
+	if conn, err := net.Dial("unix", s.path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", s.path)
+	}
+	os.Remove(s.path)
+	listener, err := net.Listen("unix", s.path)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %v", s.path, err)
+	}
+	mode := os.FileMode(0600)
+	if peerCredentialsSupported {
+		mode = 0666
+	}
+	if err := os.Chmod(s.path, mode); err != nil {
+		listener.Close()
+		return err
+	}
+	s.listener = listener
+	s.wg.Add(1)
+	go s.serve()
+	logrus.Infof("Control socket listening on %s", s.path)
+	return nil
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn.(*net.UnixConn))
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *Server) serveConn(conn *net.UnixConn) {
+	defer conn.Close()
+	privileged := true
+	if peerCredentialsSupported {
+		uid, err := peerUID(conn)
+		if err != nil {
+			logrus.Warnf("Failed to read control peer credentials: %v", err)
+			return
+		}
+		privileged = uid == 0 || uid == os.Getuid()
+	}
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Minute))
+		if !scanner.Scan() {
+			return
+		}
+		var request Request
+		response := Response{}
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			response.Error = fmt.Sprintf("invalid request: %v", err)
+		} else {
+			response = s.call(request, privileged)
+		}
+		if err := encoder.Encode(response); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) call(request Request, privileged bool) Response {
+	response := Response{ID: request.ID}
+	s.mu.RLock()
+	m, ok := s.methods[request.Method]
+	s.mu.RUnlock()
+	if !ok {
+		response.Error = fmt.Sprintf("unknown method %q", request.Method)
+		return response
+	}
+	if m.privileged && !privileged {
+		response.Error = ErrPermission.Error()
+		return response
+	}
+	result, err := m.handler(request.Params)
+	if err != nil {
+		response.Error = err.Error()
+		return response
+	}
+	if result != nil {
+		data, err := json.Marshal(result)
+		if err != nil {
+			response.Error = err.Error()
+			return response
+		}
+		response.Result = data
+	}
+	return response
+}
+
+func (s *Server) Stop() {
+	if s.listener == nil {
+		return
+	}
+	s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	os.Remove(s.path)
+}
@@ -0,0 +1,282 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type IssuedCert struct {
+	Name      string    `json:"name"`
+	Serial    string    `json:"serial"`
+	NotAfter  time.Time `json:"not_after"`
+	Revoked   bool      `json:"revoked,omitempty"`
+	RevokedAt time.Time `json:"revoked_at,omitempty"`
+}
+
+type CA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+
+	mu         sync.Mutex
+	crlModTime time.Time
+	revoked    map[string]bool
+}
+
+func LoadOrCreateCA(dir string) (*CA, error) {
+	certFile := filepath.Join(dir, "ca.crt")
+	keyFile := filepath.Join(dir, "ca.key")
+	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+		template := &x509.Certificate{
+			Subject: pkix.Name{
+				Organization: []string{"VPN Server"},
+				CommonName:   "VPN Client CA",
+			},
+			NotBefore:             time.Now(),
+			NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		certPEM, keyPEM, err := signCertificate(template, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("generate CA: %v", err)
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			return nil, fmt.Errorf("write CA key: %v", err)
+		}
+		if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+			return nil, fmt.Errorf("write CA certificate: %v", err)
+		}
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load CA: %v", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse CA certificate: %v", err)
+	}
+	key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("CA key must be an RSA key")
+	}
+	return &CA{dir: dir, cert: cert, key: key}, nil
+}
+
+func (ca *CA) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+func (ca *CA) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func (ca *CA) Issue(name string, validity time.Duration) (certPEM, keyPEM []byte, err error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	template := &x509.Certificate{
+		Subject: pkix.Name{
+			Organization: []string{"VPN Client"},
+			CommonName:   name,
+		},
+		DNSNames:    []string{name},
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certPEM, keyPEM, err = signCertificate(template, ca.cert, ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	issued, err := ca.loadIssued()
+	if err != nil {
+		return nil, nil, err
+	}
+	issued = append(issued, IssuedCert{
+		Name:     name,
+		Serial:   template.SerialNumber.Text(16),
+		NotAfter: template.NotAfter,
+	})
+	if err := ca.saveIssued(issued); err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+func (ca *CA) Revoke(name string) error {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	issued, err := ca.loadIssued()
+	if err != nil {
+		return err
+	}
+	found := false
+	for i := range issued {
+		if issued[i].Name == name && !issued[i].Revoked {
+			issued[i].Revoked = true
+			issued[i].RevokedAt = time.Now()
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("no active certificate for %s", name)
+	}
+	if err := ca.saveIssued(issued); err != nil {
+		return err
+	}
+	return ca.writeCRL(issued)
+}
+
+func (ca *CA) List() ([]IssuedCert, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return ca.loadIssued()
+}
+
+func (ca *CA) writeCRL(issued []IssuedCert) error {
+	var entries []x509.RevocationListEntry
+	for _, cert := range issued {
+		if !cert.Revoked {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(cert.Serial, 16)
+		if !ok {
+			return fmt.Errorf("invalid serial %q", cert.Serial)
+		}
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: cert.RevokedAt,
+		})
+	}
+	template := &x509.RevocationList{
+		RevokedCertificateEntries: entries,
+		Number:                    big.NewInt(time.Now().UnixNano()),
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().Add(365 * 24 * time.Hour),
+	}
+	crlDER, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	if err != nil {
+		return fmt.Errorf("create CRL: %v", err)
+	}
+	crlPEM := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER})
+	return writeFileAtomic(filepath.Join(ca.dir, "crl.pem"), crlPEM, 0644)
+}
+
+// IsRevoked checks serial against crl.pem, re-reading the file whenever it
+// changes so revocations made by the ca command apply to the next handshake.
+func (ca *CA) IsRevoked(serial *big.Int) (bool, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	path := filepath.Join(ca.dir, "crl.pem")
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if ca.revoked == nil || info.ModTime() != ca.crlModTime {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return false, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return false, errors.New("invalid CRL file")
+		}
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return false, fmt.Errorf("parse CRL: %v", err)
+		}
+		if err := crl.CheckSignatureFrom(ca.cert); err != nil {
+			return false, fmt.Errorf("verify CRL: %v", err)
+		}
+		ca.revoked = make(map[string]bool)
+		for _, entry := range crl.RevokedCertificateEntries {
+			ca.revoked[entry.SerialNumber.Text(16)] = true
+		}
+		ca.crlModTime = info.ModTime()
+	}
+	return ca.revoked[serial.Text(16)], nil
+}
+
+func (ca *CA) loadIssued() ([]IssuedCert, error) {
+	var issued []IssuedCert
+	data, err := os.ReadFile(filepath.Join(ca.dir, "issued.json"))
+	if os.IsNotExist(err) {
+		return issued, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &issued); err != nil {
+		return nil, fmt.Errorf("parse issued.json: %v", err)
+	}
+	return issued, nil
+}
+
+func (ca *CA) saveIssued(issued []IssuedCert) error {
+	data, err := json.MarshalIndent(issued, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(ca.dir, "issued.json"), data, 0600)
+}
+
+func EnableClientAuth(tlsConfig *tls.Config, ca *CA, optional bool) {
+	tlsConfig.ClientCAs = ca.CertPool()
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	if optional {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	tlsConfig.VerifyPeerCertificate = func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(verifiedChains) == 0 {
+			return nil
+		}
+		revoked, err := ca.IsRevoked(verifiedChains[0][0].SerialNumber)
+		if err != nil {
+			return fmt.Errorf("check revocation: %v", err)
+		}
+		if revoked {
+			return errors.New("client certificate has been revoked")
+		}
+		return nil
+	}
+}
+
+func CertIdentity(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return ""
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -10,9 +10,14 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
 	"io"
 	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
@@ -58,45 +63,171 @@ func (c *Cipher) Decrypt(ciphertext []byte) ([]byte, error) {
 	return text, nil
 }
 
-func GenerateCertificate() (tls.Certificate, error) {
-	privacy, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return tls.Certificate{}, err
-	}
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
+func GenerateCertificate(hosts []string) (certPEM, keyPEM []byte, err error) {
+	template := &x509.Certificate{
 		Subject: pkix.Name{
 			Organization: []string{"VPN Server"},
 		},
 		NotBefore:   time.Now(),
-		NotAfter:    time.Now().Add(365 * 24 * time.Hour),
+		NotAfter:    time.Now().Add(10 * 365 * 24 * time.Hour),
 		KeyUsage:    x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		IPAddresses: []net.IP{net.IPv4(0, 0, 0, 0)},
 	}
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &privacy.PublicKey, privacy)
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	if len(template.DNSNames) > 0 {
+		template.Subject.CommonName = template.DNSNames[0]
+	}
+	return signCertificate(template, nil, nil)
+}
+
+// signCertificate generates a new key for template and signs it with
+// parentKey, or self-signs it when parent is nil.
+func signCertificate(template, parent *x509.Certificate, parentKey *rsa.PrivateKey) (certPEM, keyPEM []byte, err error) {
+	privacy, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		return tls.Certificate{}, err
+		return nil, nil, err
+	}
+	template.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	if parent == nil {
+		parent, parentKey = template, privacy
 	}
-	cerPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privacy)})
-	return tls.X509KeyPair(cerPEM, keyPEM)
+	certDER, err := x509.CreateCertificate(rand.Reader, template, parent, &privacy.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privacy)})
+	return certPEM, keyPEM, nil
 }
 
-func NewServerTSLConfig() (*tls.Config, error) {
-	cert, err := GenerateCertificate()
+func LoadOrCreateSelfSigned(certFile, keyFile string, hosts []string) error {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if certErr == nil && keyErr == nil {
+		return nil
+	}
+	certPEM, keyPEM, err := GenerateCertificate(hosts)
 	if err != nil {
+		return fmt.Errorf("generate certificate: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(certFile), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return fmt.Errorf("write key: %v", err)
+	}
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return fmt.Errorf("write certificate: %v", err)
+	}
+	return nil
+}
+
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	reloader := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := reloader.Reload(); err != nil {
 		return nil, err
 	}
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS12,
-	}, nil
+	return reloader, nil
+}
+
+func (r *CertReloader) Reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load key pair: %v", err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("parse certificate: %v", err)
+		}
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+	return nil
 }
 
-func NewClientTSLConfig(skipVerify bool) *tls.Config {
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			modTime, err := r.latestModTime()
+			if err != nil {
+				logrus.Warnf("failed to stat certificate files: %v", err)
+				continue
+			}
+			r.mu.RLock()
+			changed := modTime.After(r.modTime)
+			r.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := r.Reload(); err != nil {
+				logrus.Warnf("failed to reload certificate, keeping the current one: %v", err)
+				continue
+			}
+			logrus.Infof("reloaded TLS certificate from %s, pin %s", r.certFile, r.Pin())
+		}
+	}
+}
+
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func NewServerTSLConfig(reloader *CertReloader) *tls.Config {
 	return &tls.Config{
-		InsecureSkipVerify: skipVerify,
-		MinVersion:         tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
 	}
 }
+
+func (r *CertReloader) Pin() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return SPKIPin(r.cert.Leaf)
+}
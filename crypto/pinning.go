@@ -0,0 +1,152 @@
+package crypto
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const pinPrefix = "sha256/"
+
+type ClientTLSOptions struct {
+	ServerName      string
+	CertFile        string
+	KeyFile         string
+	CertPEM         []byte
+	KeyPEM          []byte
+	CAFile          string
+	Pin             string
+	TrustOnFirstUse bool
+	KnownHostsFile  string
+}
+
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return pinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func NewClientTSLConfig(opts ClientTLSOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: opts.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if opts.CertFile != "" && opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else if len(opts.CertPEM) > 0 {
+		cert, err := tls.X509KeyPair(opts.CertPEM, opts.KeyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if opts.CAFile != "" {
+		caPEM, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+		if opts.Pin == "" {
+			return tlsConfig, nil
+		}
+	} else if opts.Pin == "" && !opts.TrustOnFirstUse {
+		return nil, errors.New("no way to verify the server certificate, set a CA, a pin or trust on first use")
+	} else {
+		// chain verification is replaced by the pin checks below
+		tlsConfig.InsecureSkipVerify = true
+	}
+	if opts.Pin != "" && !strings.HasPrefix(opts.Pin, pinPrefix) {
+		return nil, fmt.Errorf("invalid pin %q, expected %s<base64>", opts.Pin, pinPrefix)
+	}
+	knownHosts := NewKnownHosts(opts.KnownHostsFile)
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("server sent no certificate")
+		}
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return fmt.Errorf("parse server certificate: %v", err)
+		}
+		pin := SPKIPin(leaf)
+		if opts.Pin != "" {
+			if subtle.ConstantTimeCompare([]byte(pin), []byte(opts.Pin)) != 1 {
+				return fmt.Errorf("server certificate pin %s does not match %s", pin, opts.Pin)
+			}
+			return nil
+		}
+		return knownHosts.Verify(opts.ServerName, pin)
+	}
+	return tlsConfig, nil
+}
+
+type KnownHosts struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewKnownHosts(path string) *KnownHosts {
+	return &KnownHosts{path: path}
+}
+
+func (k *KnownHosts) load() (map[string]string, error) {
+	hosts := make(map[string]string)
+	file, err := os.Open(k.path)
+	if os.IsNotExist(err) {
+		return hosts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && !strings.HasPrefix(fields[0], "#") {
+			hosts[fields[0]] = fields[1]
+		}
+	}
+	return hosts, scanner.Err()
+}
+
+func (k *KnownHosts) Verify(host, pin string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	hosts, err := k.load()
+	if err != nil {
+		return fmt.Errorf("read known hosts: %v", err)
+	}
+	known, ok := hosts[host]
+	if ok {
+		if known != pin {
+			return fmt.Errorf("certificate pin for %s changed from %s to %s, remove the entry from %s if this is expected",
+				host, known, pin, k.path)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(k.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("write known hosts: %v", err)
+	}
+	defer file.Close()
+	_, err = fmt.Fprintf(file, "%s %s\n", host, pin)
+	return err
+}
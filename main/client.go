@@ -1,32 +1,86 @@
 package main
 
 import (
-	"bufio"
-	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"vpn/client"
 	"vpn/config"
+	"vpn/control"
+	"vpn/metrics"
+	"vpn/network"
 )
 
 func main() {
-	var (
-		serverAddr = flag.String("server", "localhost:9999", "VPN server address")
-		clientIP   = flag.String("ip", "10.0.0.2", "Client VPN IP")
-		dns        = flag.String("dns", "8.8.8.8,8.8.4.4", "DNS server (comma separated)")
-		mtu        = flag.Int("mtu", 1400, "MTU size")
-		loglevel   = flag.String("log", "info", "Log level (debug, info, warn, error)")
-		key        = flag.String("key", "", "Shared key (hex encoded)")
-		stats      = flag.Bool("stats", false, "Show statistics")
-	)
+	if len(os.Args) > 1 && os.Args[1] == "cleanup" {
+		runCleanup(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "profile" {
+		runProfile(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		runConfig(os.Args[2:])
+		return
+	}
+	configFile := flag.String("config", "", "Configuration file (YAML)")
+	profile := flag.String("profile", "", "Connect with a stored profile (see the profile command)")
+	stats := flag.Bool("stats", false, "Show statistics")
+	// settings flags are applied through cfg.ApplyFlags
+	flag.String("server", "localhost:9999", "VPN server address, or several comma separated to pick the fastest and fail over")
+	flag.String("ip", "10.0.0.2", "Client VPN IP")
+	flag.String("ip6", "", "Requested client VPN IPv6 (default assigned by the server)")
+	flag.String("dns", "8.8.8.8,8.8.4.4", "DNS server (comma separated)")
+	flag.Int("mtu", 1400, "MTU size")
+	flag.String("log", "info", "Log level (debug, info, warn, error)")
+	flag.String("key", "", "Shared key in hex or base64, - reads it from stdin")
+	flag.String("key-file", "", "Shared key file")
+	flag.Duration("keepalive", 30*time.Second, "Keepalive interval proposed to the server")
+	flag.Duration("keepalive-timeout", 60*time.Second, "Reconnect when the server is silent this long")
+	flag.Duration("reconnect-delay", time.Second, "First wait before reconnecting, doubled after every failure")
+	flag.Duration("reconnect-max-delay", time.Minute, "Longest wait between reconnect attempts")
+	flag.String("control", control.DefaultSocket, "Control socket for vpnctl (empty disables)")
+	flag.String("metrics", "", "Listen address for Prometheus /metrics (empty disables)")
+	flag.String("ca", "", "CA bundle used to verify the server certificate")
+	flag.String("pin", "", "Expected server certificate pin (sha256/<base64>)")
+	flag.Bool("tofu", true, "Trust the server certificate on first use and refuse if it changes")
+	flag.String("cert", "", "Client certificate file for servers running with -mtls")
+	flag.String("tls-key", "", "Client certificate key file")
+	flag.String("data-dir", "/var/lib/govpn", "Directory for persistent client state")
+	flag.String("include", "", "Only route these CIDRs through the VPN (comma separated, default all traffic)")
+	flag.String("exclude", "", "Never route these CIDRs through the VPN (comma separated)")
+	flag.String("dns-domains", "", "Send only these DNS zones to the VPN resolvers (systemd-resolved, comma separated)")
+	flag.Int("table", 51830, "Routing table for tunnel routes (Linux)")
+	flag.Int("fwmark", 51830, "Firewall mark of the connection to the server (Linux)")
+	flag.String("domains", "", "Route only these domains through the VPN, e.g. *.corp.example (comma separated)")
+	flag.String("dns-upstream", "", "Resolvers for domains outside -domains (comma separated, default -dns)")
+	flag.String("dns-listen", "127.0.0.1:53", "Listen address of the local DNS interceptor")
+	flag.Bool("killswitch", false, "Block all traffic outside the tunnel until a clean disconnect (Linux)")
+	flag.String("allow-lan", "", "LAN ranges reachable while the kill switch is on (comma separated CIDRs)")
+	flag.Bool("block-ipv6", true, "Block IPv6 while all traffic goes through the VPN")
+	flag.Bool("block-dns-leaks", true, "Drop DNS queries to resolvers other than -dns (Linux)")
+	flag.Bool("obfs", false, "Enable traffic obfuscation")
+	flag.Int("obfs-padding", 256, "Maximum random padding per frame in bytes")
+	flag.Int("obfs-bucket", 128, "Frame sizes are rounded up to a multiple of this")
+	flag.Duration("obfs-jitter", 0, "Maximum random delay added to the cover frame schedule")
+	flag.Duration("obfs-cover", 0, "Average interval between cover frames (0 disables)")
 	flag.Parse()
-	level, err := logrus.ParseLevel(*loglevel)
+	cfg, err := loadConfig(*configFile, *profile)
+	if err != nil {
+		logrus.Fatalf("Invalid configuration:\n%v", err)
+	}
+	level, err := logrus.ParseLevel(cfg.Log)
 	if err != nil {
 		logrus.Fatalf("Invalid log level: %s", err)
 	}
@@ -37,69 +91,340 @@ func main() {
 	if os.Getegid() != 0 {
 		logrus.Fatal("This program must be run as root")
 	}
-	cfg := config.NewClientConfig(*serverAddr)
-	cfg.ClientIP = *clientIP
-	cfg.MTU = *mtu
-	if *dns != "" {
-		cfg.DNS = strings.Split(*dns, ",")
-	}
 
-	if *key != "" {
-		keyBytes, err := hex.DecodeString(*key)
-		if err != nil {
-			logrus.Fatalf("Failed to decode key: %s", err)
-		}
-		if len(keyBytes) != 32 {
-			logrus.Fatalf("Invalid key size: %d must be 32 bytes", len(keyBytes))
-		}
-		cfg.SharedKey = keyBytes
-	} else {
+	if _, err := cfg.ResolveKey(os.Stdin); err == config.ErrNoKey {
 		fmt.Print("Enter shared key: ")
-		reader := bufio.NewReader(os.Stdin)
-		keyStr, _ := reader.ReadString('\n')
-		keyStr = strings.TrimSpace(keyStr)
-		keyBytes, err := hex.DecodeString(keyStr)
-		if err != nil {
-			logrus.Fatalf("Failed to decode key: %s", err)
-		}
-		if len(keyBytes) != 32 {
-			logrus.Fatalf("Invalid key size: %d must be 32 bytes", len(keyBytes))
+		if cfg.SharedKey, err = config.ReadKey(os.Stdin); err != nil {
+			logrus.Fatalf("Failed to read key: %s", err)
 		}
-		cfg.SharedKey = keyBytes
+	} else if err != nil {
+		logrus.Fatalf("Failed to load shared key: %s", err)
 	}
 
 	logrus.Info("Starting VPN client")
 	logrus.Infof("Configuration:")
-	logrus.Infof("  Server: %s", cfg.ServerAddr)
+	logrus.Infof("  Server: %s", strings.Join(cfg.Servers, ", "))
 	logrus.Infof("  Client IP: %s", cfg.ClientIP)
 	logrus.Infof("  DNS: %v", cfg.DNS)
 	logrus.Infof("  MTU: %d", cfg.MTU)
+	if len(cfg.IncludeRoutes) > 0 {
+		logrus.Infof("  Included routes: %v", cfg.IncludeRoutes)
+	}
+	if len(cfg.ExcludeRoutes) > 0 {
+		logrus.Infof("  Excluded routes: %v", cfg.ExcludeRoutes)
+	}
+	if len(cfg.DomainRules) > 0 {
+		logrus.Infof("  Tunneled domains: %v", cfg.DomainRules)
+	}
+	logrus.Infof("  Kill switch: %v", cfg.KillSwitch)
+	logrus.Infof("  Obfuscation: %v", cfg.Obfuscate)
 
+	var current atomic.Pointer[client.Client]
 	vpnClient, err := client.NewClient(cfg)
-	if err != nil {
-		logrus.Fatalf("Failed to create VPN client: %s", err)
+	if err == nil {
+		err = connect(vpnClient, nil)
 	}
-	if err := vpnClient.Connect(); err != nil {
+	if err != nil {
 		logrus.Fatalf("Failed to connect to VPN: %s", err)
 	}
+	current.Store(vpnClient)
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	disconnectChan := make(chan struct{}, 1)
+	switchChan := make(chan *config.Config, 1)
+	var controlServer *control.Server
+	if cfg.ControlSocket != "" {
+		controlServer = control.NewServer(cfg.ControlSocket)
+		vpnClient.RegisterControl(controlServer)
+		registerProcessControl(controlServer, disconnectChan, switchChan, *configFile)
+		if err := controlServer.Start(); err != nil {
+			logrus.Warnf("Failed to start control socket: %v", err)
+		} else {
+			defer controlServer.Stop()
+		}
+	}
+	metricsServer := serveMetrics(cfg, vpnClient)
 	if *stats {
-		go showStats(vpnClient)
+		go showStats(&current)
+	}
+	for running := true; running; {
+		select {
+		case sig := <-sigChan:
+			logrus.Infof("Received signal: %s, disconnecting", sig)
+			running = false
+		case <-disconnectChan:
+			logrus.Info("Disconnect requested over the control socket")
+			running = false
+		case next := <-switchChan:
+			logrus.Infof("Switching to profile %s (%s)", next.Profile, strings.Join(next.Servers, ", "))
+			// both profiles are resolved while the tunnel still carries DNS,
+			// the kill switch blocks it once the tunnel is down
+			switched, err := prepare(next)
+			if err != nil {
+				logrus.Errorf("Failed to switch to profile %s: %s", next.Profile, err)
+				continue
+			}
+			fallback, fallbackErr := prepare(cfg)
+			// the kill switch stays up until the next client is connected
+			killSwitch, err := vpnClient.HandOver()
+			if err != nil {
+				logrus.Errorf("Failed to disconnect: %s", err)
+			}
+			if metricsServer != nil {
+				metricsServer.Close()
+			}
+			if err := connect(switched, killSwitch); err == nil {
+				cfg, vpnClient = next, switched
+			} else {
+				logrus.Errorf("Failed to connect with profile %s: %s", next.Profile, err)
+				if fallbackErr == nil {
+					fallbackErr = connect(fallback, killSwitch)
+				}
+				if fallbackErr != nil {
+					if killSwitch != nil {
+						killSwitch.Disable()
+					}
+					logrus.Fatalf("Failed to connect to VPN: %s", fallbackErr)
+				}
+				vpnClient = fallback
+			}
+			current.Store(vpnClient)
+			if controlServer != nil {
+				vpnClient.RegisterControl(controlServer)
+			}
+			metricsServer = serveMetrics(cfg, vpnClient)
+		}
+	}
+	if metricsServer != nil {
+		defer metricsServer.Close()
 	}
-	sig := <-sigChan
-	logrus.Infof("Received signal: %s, disconnecting", sig)
 	if err := vpnClient.Disconnect(); err != nil {
 		logrus.Fatalf("Failed to disconnect: %s", err)
 	}
 	logrus.Info("VPN client disconnected")
 }
 
-func showStats(client *client.Client) {
+// prepare creates a client for cfg and resolves its servers.
+func prepare(cfg *config.Config) (*client.Client, error) {
+	vpnClient, err := client.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return vpnClient, vpnClient.Resolve()
+}
+
+// connect connects vpnClient, keeping killSwitch of the previous client if
+// not nil.
+func connect(vpnClient *client.Client, killSwitch *network.KillSwitch) error {
+	if err := vpnClient.TakeOver(killSwitch); err != nil {
+		return err
+	}
+	return vpnClient.Connect()
+}
+
+func serveMetrics(cfg *config.Config, vpnClient *client.Client) *http.Server {
+	if cfg.MetricsAddr == "" {
+		return nil
+	}
+	metricsServer, err := metrics.Serve(cfg.MetricsAddr, vpnClient.MetricsRegistry())
+	if err != nil {
+		logrus.Warnf("Failed to start metrics listener: %v", err)
+		return nil
+	}
+	return metricsServer
+}
+
+func registerProcessControl(server *control.Server, disconnectChan chan struct{}, switchChan chan *config.Config, configFile string) {
+	server.Handle("disconnect", true, func(json.RawMessage) (interface{}, error) {
+		select {
+		case disconnectChan <- struct{}{}:
+		default:
+		}
+		return nil, nil
+	})
+	server.Handle("log_level", true, func(params json.RawMessage) (interface{}, error) {
+		var request struct {
+			Level string `json:"level"`
+		}
+		if err := json.Unmarshal(params, &request); err != nil {
+			return nil, err
+		}
+		level, err := logrus.ParseLevel(request.Level)
+		if err != nil {
+			return nil, err
+		}
+		logrus.SetLevel(level)
+		logrus.Infof("Log level set to %s", level)
+		return nil, nil
+	})
+	server.Handle("switch_profile", true, func(params json.RawMessage) (interface{}, error) {
+		var request struct {
+			Profile string `json:"profile"`
+		}
+		if err := json.Unmarshal(params, &request); err != nil {
+			return nil, err
+		}
+		cfg, err := loadConfig(configFile, request.Profile)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := cfg.ResolveKey(strings.NewReader("")); err != nil {
+			return nil, fmt.Errorf("profile %s: %v", request.Profile, err)
+		}
+		select {
+		case switchChan <- cfg:
+		default:
+			return nil, fmt.Errorf("a profile switch is already in progress")
+		}
+		return nil, nil
+	})
+}
+
+// loadConfig builds the configuration from defaults, the file, GOVPN_*
+// environment variables and command line flags, in increasing precedence.
+func loadConfig(path, profile string) (*config.Config, error) {
+	cfg := config.NewClientConfig("localhost:9999")
+	if err := cfg.Load(path); err != nil {
+		return nil, err
+	}
+	if err := cfg.ApplyFlags(flag.CommandLine); err != nil {
+		return nil, err
+	}
+	if profile != "" {
+		// the profile overrides the file, environment and flags still win
+		if err := cfg.LoadProfileSettings(profile); err != nil {
+			return nil, err
+		}
+		if err := cfg.LoadEnv(); err != nil {
+			return nil, err
+		}
+		if err := cfg.ApplyFlags(flag.CommandLine); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, cfg.Validate()
+}
+
+func runConfig(args []string) {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s config check <file>\n", os.Args[0])
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 || fs.Arg(0) != "check" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if _, err := loadConfig(fs.Arg(1), ""); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: OK\n", fs.Arg(1))
+}
+
+func runProfile(args []string) {
+	fs := flag.NewFlagSet("profile", flag.ExitOnError)
+	dataDir := fs.String("data-dir", "/var/lib/govpn", "Directory for persistent client state")
+	name := fs.String("name", "", "Profile name (import only, default the name in the URI or the file name)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s profile <import|list|show|remove> [options] [uri|file|name]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	command := args[0]
+	fs.Parse(args[1:])
+	switch command {
+	case "import":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		var profile *config.Profile
+		var err error
+		if strings.HasPrefix(fs.Arg(0), config.URIScheme+"://") {
+			profile, err = config.ParseURI(fs.Arg(0))
+		} else {
+			profile, err = config.ReadProfile(fs.Arg(0))
+		}
+		if err == nil && len(profile.Server) == 0 {
+			err = errors.New("no server address")
+		}
+		if err != nil {
+			logrus.Fatalf("Invalid profile: %v", err)
+		}
+		if *name != "" {
+			profile.Name = *name
+		} else if profile.Name == "" {
+			profile.Name, _, _ = net.SplitHostPort(profile.Server[0])
+		}
+		if err := config.SaveProfile(*dataDir, profile); err != nil {
+			logrus.Fatalf("Failed to save profile: %v", err)
+		}
+		fmt.Printf("Imported profile %s for %s\n", profile.Name, profile.Server)
+	case "list":
+		names, err := config.ListProfiles(*dataDir)
+		if err != nil {
+			logrus.Fatalf("Failed to list profiles: %v", err)
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+	case "show":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		profile, err := config.LoadProfile(*dataDir, fs.Arg(0))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		fmt.Printf("Server: %s\n", profile.Server)
+		if profile.IP != "" {
+			fmt.Printf("IP:     %s\n", profile.IP)
+		}
+		if profile.CertPEM != "" {
+			fmt.Printf("Client certificate: embedded\n")
+		} else if uri, err := profile.URI(); err != nil {
+			logrus.Fatalf("Profile %s: %v", profile.Name, err)
+		} else {
+			fmt.Printf("URI:    %s\n", uri)
+		}
+	case "remove":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		if err := config.RemoveProfile(*dataDir, fs.Arg(0)); err != nil {
+			logrus.Fatal(err)
+		}
+		fmt.Printf("Removed profile %s\n", fs.Arg(0))
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+func runCleanup(args []string) {
+	fs := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	dataDir := fs.String("data-dir", "/var/lib/govpn", "Directory for persistent client state")
+	fs.Parse(args)
+	if os.Getegid() != 0 {
+		logrus.Fatal("This program must be run as root")
+	}
+	if err := client.Cleanup(*dataDir); err != nil {
+		logrus.Fatalf("Cleanup failed: %v", err)
+	}
+	logrus.Info("Host network configuration restored")
+}
+
+func showStats(current *atomic.Pointer[client.Client]) {
 	ticker := time.NewTicker(time.Second * 5)
 	defer ticker.Stop()
 	for range ticker.C {
-		bytesIn, bytesOut := client.GetStats()
+		bytesIn, bytesOut := current.Load().GetStats()
 		logrus.Infof("Statistics: IN: %s, OUT: %s",
 			formatBytes(bytesIn), formatBytes(bytesOut))
 	}
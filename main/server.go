@@ -1,29 +1,81 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/mdp/qrterminal/v3"
 	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
+	"vpn/cluster"
 	"vpn/config"
+	"vpn/crypto"
 	"vpn/server"
 )
 
 func main() {
-	var (
-		listenAddr = flag.String("listen", ":9999", "Listen address")
-		serverIP   = flag.String("ip", "10.0.0.1", "Server VPN IP")
-		subnet     = flag.String("subnet", "10.0.0.0/24", "VPN subnet")
-		mtu        = flag.Int("mtu", 1400, "MTU size")
-		logLevel   = flag.String("log", "info", "Log level (debug, info, warn, error)")
-		keyFile    = flag.String("key", "", "Shared key file (if not specified, generates random)")
-	)
+	if len(os.Args) > 1 && os.Args[1] == "ca" {
+		runCA(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		runKeygen(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		runConfig(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "peer" {
+		runPeer(os.Args[2:])
+		return
+	}
+	configFile := flag.String("config", "", "Configuration file (YAML)")
+	// settings flags are applied through cfg.ApplyFlags
+	flag.String("key", "", "Shared key in hex or base64, - reads it from stdin")
+	flag.String("key-file", "", "Shared key file (default <data-dir>/shared.key, generated on first start)")
+	flag.String("listen", ":9999", "Listen address")
+	flag.String("ip", "10.0.0.1", "Server VPN IP")
+	flag.String("subnet", "10.0.0.0/24", "VPN subnet")
+	flag.String("ip6", "", "Server VPN IPv6 (default derived from -ip and -subnet6)")
+	flag.String("subnet6", "", "VPN IPv6 subnet, e.g. fd00:7670::/64 (empty disables IPv6)")
+	flag.String("nat6", "masquerade", "IPv6 NAT: masquerade, none, or a public prefix for NPTv6")
+	flag.Int("mtu", 1400, "MTU size")
+	flag.String("log", "info", "Log level (debug, info, warn, error)")
+	flag.Bool("obfs", false, "Allow clients to negotiate traffic obfuscation")
+	flag.String("cert", "", "TLS certificate chain file (PEM)")
+	flag.String("tls-key", "", "TLS private key file (PEM)")
+	flag.String("data-dir", "/var/lib/govpn", "Directory for persistent server state")
+	flag.String("fallback", "", "HTTP backend address that receives connections failing the VPN handshake")
+	flag.Bool("mtls", false, "Require client certificates issued by the built-in CA")
+	flag.String("admin", "", "Listen address of the admin HTTP API, e.g. 127.0.0.1:9090 (empty disables)")
+	flag.String("admin-token", "", "Admin API bearer token (default generated in <data-dir>/admin.token)")
+	flag.String("metrics", "", "Listen address for Prometheus /metrics (empty disables)")
+	flag.String("endpoint", "", "Public host:port clients connect to, written into generated profiles (comma separated)")
+	flag.String("push-dns", "", "Comma-separated DNS servers written into generated profiles")
+	flag.String("push-routes", "", "Comma-separated CIDRs clients route through the VPN, written into generated profiles")
+	flag.String("cluster-store", "", "Shared cluster state file, e.g. on NFS (empty disables cluster mode)")
+	flag.String("cluster-node", "", "Name of this node in the cluster (default the hostname)")
+	flag.String("cluster-listen", ":9998", "Listen address of the inter-node link")
+	flag.String("cluster-addr", "", "Address other nodes reach the link at (default hostname and -cluster-listen port)")
+	flag.String("cluster-key", "", "Key of the inter-node link in hex or base64, see keygen")
 	flag.Parse()
-	level, err := logrus.ParseLevel(*logLevel)
+	cfg, err := loadConfig(*configFile)
 	if err != nil {
-		logrus.Fatalf("Invalid log level: %s", *logLevel)
+		logrus.Fatalf("Invalid configuration:\n%v", err)
+	}
+	level, err := logrus.ParseLevel(cfg.Log)
+	if err != nil {
+		logrus.Fatalf("Invalid log level: %s", cfg.Log)
 	}
 	logrus.SetLevel(level)
 	logrus.SetFormatter(&logrus.TextFormatter{
@@ -32,41 +84,501 @@ func main() {
 	if os.Getegid() != 0 {
 		logrus.Fatal("This program must be run as root")
 	}
-	cfg := config.NewServerConfig()
-	cfg.ListenAddr = *listenAddr
-	cfg.ServerIP = *serverIP
-	cfg.VPNSubnet = *subnet
-	cfg.MTU = *mtu
-	if *keyFile != "" {
-		logrus.Warn("Key file loading not implemented yet, using random key")
+	if err := loadPeers(cfg); err != nil {
+		logrus.Fatalf("Failed to load peers: %v", err)
+	}
+	keySource, err := cfg.ResolveKey(os.Stdin)
+	if err != nil {
+		logrus.Fatalf("Failed to load shared key: %v", err)
 	}
 	logrus.Info("Starting GoVPN Server")
 	logrus.Infof("Configuration:")
 	logrus.Infof("  Listen address: %s", cfg.ListenAddr)
 	logrus.Infof("  Server IP: %s", cfg.ServerIP)
 	logrus.Infof("  VPN Subnet: %s", cfg.VPNSubnet)
+	if cfg.VPNSubnet6 != "" {
+		logrus.Infof("  VPN IPv6 Subnet: %s (NAT: %s)", cfg.VPNSubnet6, cfg.NAT6)
+	}
 	logrus.Infof("  MTU: %d", cfg.MTU)
-	logrus.Infof("  Shared Key: %s", cfg.KeyString())
+	logrus.Infof("  Obfuscation: %v", cfg.Obfuscate)
+	if cfg.FallbackAddr != "" {
+		logrus.Infof("  Fallback backend: %s", cfg.FallbackAddr)
+	}
+	logrus.Infof("  Shared key: %s, fingerprint %s", keySource, cfg.SharedKey.Fingerprint())
+	if cfg.ClusterStore != "" {
+		logrus.Infof("  Cluster store: %s", cfg.ClusterStore)
+	}
 
 	server, err := server.NewServer(cfg)
 	if err != nil {
 		logrus.Fatalf("Failed to create server: %v", err)
 	}
+	server.SetConfigLoader(func() (*config.Config, error) {
+		cfg, err := loadConfig(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		return cfg, loadPeers(cfg)
+	})
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
 		if err := server.Start(); err != nil {
 			logrus.Fatalf("Failed to start server: %v", err)
 		}
 	}()
-	sig := <-sigChan
-	logrus.Infof("Received signal %v, shutting down", sig)
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
+			logrus.Infof("Received signal %v, shutting down", sig)
+			break
+		}
+		logrus.Info("Received SIGHUP, reloading configuration")
+		if err := server.ReloadConfig(); err != nil {
+			logrus.Errorf("Reload failed, keeping the running configuration:\n%v", err)
+		}
+	}
 	if err := server.Stop(); err != nil {
 		logrus.Fatalf("Failed to stop server: %v", err)
 	}
 	logrus.Info("Server stopped")
 }
 
+// loadConfig builds the configuration from defaults, the file, GOVPN_*
+// environment variables and command line flags, in increasing precedence.
+func loadConfig(path string) (*config.Config, error) {
+	cfg := config.NewServerConfig()
+	if err := cfg.Load(path); err != nil {
+		return nil, err
+	}
+	if err := cfg.ApplyFlags(flag.CommandLine); err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// loadPeers adds the peers managed in peers.json to those of the file.
+func loadPeers(cfg *config.Config) error {
+	if !cfg.RequireClientCert && cfg.AdminAddr == "" {
+		return nil
+	}
+	peers, err := config.LoadPeers(config.PeersFile(cfg.DataDir))
+	if err != nil {
+		return err
+	}
+	for _, name := range config.ShadowedPeers(cfg.Peers, peers) {
+		logrus.Warnf("Peer %s of the configuration file is overridden by peers.json, change it with the admin API or peer commands", name)
+	}
+	cfg.Peers = config.MergePeers(cfg.Peers, peers)
+	return nil
+}
+
+func runConfig(args []string) {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s config check <file>\n", os.Args[0])
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 || fs.Arg(0) != "check" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if _, err := loadConfig(fs.Arg(1)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: OK\n", fs.Arg(1))
+}
+
+func runKeygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := fs.String("out", "", "Also write the key to this file (mode 0600, must not exist)")
+	fs.Parse(args)
+	key, err := config.GenerateKey()
+	if err != nil {
+		logrus.Fatalf("Failed to generate key: %v", err)
+	}
+	if *out != "" {
+		if err := config.SaveKeyFile(*out, key); err != nil {
+			logrus.Fatalf("Failed to write key: %v", err)
+		}
+	}
+	fmt.Printf("hex:    %s\n", key.Hex())
+	fmt.Printf("base64: %s\n", key.Base64())
+}
+
+func runPeer(args []string) {
+	fs := flag.NewFlagSet("peer", flag.ExitOnError)
+	configFile := fs.String("config", "", "Server configuration file (YAML)")
+	dataDir := fs.String("data-dir", "", "Directory for persistent server state (default from the configuration)")
+	endpoint := fs.String("endpoint", "", "Public host:port of the server, comma separated (default the endpoint setting)")
+	ip := fs.String("ip", "", "Tunnel IP of the peer (default the first free address of the subnet)")
+	dns := fs.String("dns", "", "Comma-separated DNS servers for the peer (default the push-dns setting)")
+	routes := fs.String("routes", "", "Comma-separated CIDRs routed through the VPN (default the push-routes setting)")
+	out := fs.String("out", "", "Write the profile to this file instead of stdout")
+	qr := fs.Bool("qr", false, "Print the govpn:// URI as a QR code")
+	days := fs.Int("days", 365, "Client certificate validity in days (with -mtls)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s peer add [options] <name>\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "add" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	name := fs.Arg(0)
+	if err := config.ValidProfileName(name); err != nil {
+		logrus.Fatal(err)
+	}
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		logrus.Fatalf("Invalid configuration:\n%v", err)
+	}
+	if *dataDir != "" {
+		cfg.DataDir = *dataDir
+	}
+	endpoints := cfg.PublicEndpoints
+	if *endpoint != "" {
+		endpoints = strings.Split(*endpoint, ",")
+	}
+	if len(endpoints) == 0 {
+		logrus.Fatal("No endpoint: pass -endpoint or set endpoint in the configuration")
+	}
+	if _, err := cfg.ResolveKey(os.Stdin); err != nil {
+		logrus.Fatalf("Failed to load shared key: %v", err)
+	}
+	pin, err := serverPin(cfg)
+	if err != nil {
+		logrus.Fatalf("Failed to read the server certificate: %v", err)
+	}
+
+	peersFile := config.PeersFile(cfg.DataDir)
+	peers, err := config.LoadPeers(peersFile)
+	if err != nil {
+		logrus.Fatalf("Failed to load peers: %v", err)
+	}
+	if config.FindPeer(config.MergePeers(cfg.Peers, peers), name) != nil {
+		logrus.Fatalf("Peer %q already exists", name)
+	}
+	if *qr && *out != "" {
+		logrus.Fatal("-qr prints the profile to the terminal and cannot be combined with -out")
+	}
+	if *qr && cfg.RequireClientCert {
+		logrus.Fatal("A profile with a client certificate does not fit in a QR code, use -out")
+	}
+	if *ip, err = peerIP(cfg, config.MergePeers(cfg.Peers, peers), *ip); err != nil {
+		logrus.Fatalf("Cannot assign an IP: %v", err)
+	}
+	profile := &config.Profile{
+		Name:    name,
+		Server:  endpoints,
+		Key:     cfg.SharedKey.Hex(),
+		Pin:     pin,
+		IP:      *ip,
+		DNS:     cfg.PushDNS,
+		MTU:     cfg.MTU,
+		Include: cfg.PushRoutes,
+		Obfs:    cfg.Obfuscate,
+	}
+	if *dns != "" {
+		profile.DNS = strings.Split(*dns, ",")
+	}
+	if *routes != "" {
+		profile.Include = strings.Split(*routes, ",")
+	}
+	// everything done after the certificate is issued is undone on failure,
+	// so neither a valid certificate nor a profile of an unknown peer is left
+	var undo []func()
+	fail := func(format string, args ...interface{}) {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+		logrus.Fatalf(format, args...)
+	}
+	if cfg.RequireClientCert {
+		ca, err := crypto.LoadOrCreateCA(filepath.Join(cfg.DataDir, "ca"))
+		if err != nil {
+			logrus.Fatalf("Failed to load CA: %v", err)
+		}
+		certPEM, keyPEM, err := ca.Issue(name, time.Duration(*days)*24*time.Hour)
+		if err != nil {
+			logrus.Fatalf("Failed to issue certificate: %v", err)
+		}
+		undo = append(undo, func() {
+			if err := ca.Revoke(name); err != nil {
+				logrus.Errorf("Failed to revoke the certificate of %s: %v", name, err)
+			}
+		})
+		profile.CertPEM, profile.KeyPEM = string(certPEM), string(keyPEM)
+	}
+	// The profile is written before the peer is registered, so a failed
+	// write does not leave a peer nobody has the profile of.
+	var data []byte
+	if *qr {
+		uri, err := profile.URI()
+		if err != nil {
+			fail("%v", err)
+		}
+		data = []byte(uri + "\n")
+	} else if data, err = profile.Marshal(); err != nil {
+		fail("%v", err)
+	}
+	if *out != "" {
+		if err := os.WriteFile(*out, data, 0600); err != nil {
+			fail("Failed to write profile: %v", err)
+		}
+		undo = append(undo, func() { os.Remove(*out) })
+	}
+	applied, err := registerPeer(cfg, config.Peer{Name: name, IP: *ip})
+	if err != nil {
+		fail("Failed to add peer: %v", err)
+	}
+
+	switch {
+	case *qr:
+		qrterminal.GenerateHalfBlock(strings.TrimSpace(string(data)), qrterminal.L, os.Stdout)
+		os.Stdout.Write(data)
+	case *out != "":
+		fmt.Fprintf(os.Stderr, "Wrote profile for %s (%s) to %s\n", name, *ip, *out)
+	default:
+		os.Stdout.Write(data)
+	}
+	if applied {
+		fmt.Fprintf(os.Stderr, "Added peer %s with IP %s\n", name, *ip)
+	} else {
+		fmt.Fprintf(os.Stderr, "Added peer %s with IP %s; send SIGHUP to a running server to apply\n", name, *ip)
+	}
+}
+
+// peerIP checks the requested IP of a new peer, or picks the first free one
+// when it is empty. In a cluster the peers and leases of the cluster store
+// count as well.
+func peerIP(cfg *config.Config, peers []config.Peer, requested string) (string, error) {
+	if cfg.ClusterStore == "" {
+		if requested == "" {
+			return config.AllocatePeerIP(cfg.VPNSubnet, cfg.ServerIP, peers)
+		}
+		return requested, config.CheckPeerIP(cfg.VPNSubnet, cfg.ServerIP, requested, peers)
+	}
+	store, err := cluster.NewFileStore(cfg.ClusterStore)
+	if err != nil {
+		return "", fmt.Errorf("open cluster store: %v", err)
+	}
+	defer store.Close()
+	state, err := store.Load()
+	if err != nil {
+		return "", fmt.Errorf("read cluster store: %v", err)
+	}
+	now := time.Now()
+	state.Expire(now)
+	peers = config.MergePeers(peers, state.Peers)
+	if requested != "" {
+		if err := config.CheckPeerIP(cfg.VPNSubnet, cfg.ServerIP, requested, peers); err != nil {
+			return "", err
+		}
+		if lease := state.Leases[requested]; lease != nil {
+			return "", fmt.Errorf("IP %s is leased to a session on node %s", requested, lease.Node)
+		}
+		return requested, nil
+	}
+	_, subnet, err := net.ParseCIDR(cfg.VPNSubnet)
+	if err != nil {
+		return "", err
+	}
+	reserved := map[string]bool{cfg.ServerIP: true}
+	for _, peer := range peers {
+		if peer.IP != "" {
+			reserved[peer.IP] = true
+		}
+	}
+	if ip := state.Allocate("", "", "", subnet, reserved, now); ip != "" {
+		return ip, nil
+	}
+	return "", fmt.Errorf("no free address left in %s", subnet)
+}
+
+var errAdminUnreachable = errors.New("admin API unreachable")
+
+// registerPeer adds peer through the admin API of a running server, which
+// owns peers.json while it runs, and writes peers.json itself when no server
+// answers. It reports whether the running server already uses the peer.
+func registerPeer(cfg *config.Config, peer config.Peer) (bool, error) {
+	if cfg.AdminAddr != "" {
+		err := postPeer(cfg, peer)
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, errAdminUnreachable) {
+			return false, err
+		}
+	}
+	peersFile := config.PeersFile(cfg.DataDir)
+	peers, err := config.LoadPeers(peersFile)
+	if err != nil {
+		return false, err
+	}
+	if config.FindPeer(peers, peer.Name) != nil {
+		return false, fmt.Errorf("peer %q already exists", peer.Name)
+	}
+	return false, config.SavePeers(peersFile, append(peers, peer))
+}
+
+func postPeer(cfg *config.Config, peer config.Peer) error {
+	token := cfg.AdminToken
+	if token == "" {
+		data, err := os.ReadFile(filepath.Join(cfg.DataDir, "admin.token"))
+		if err != nil {
+			return fmt.Errorf("%w: %v", errAdminUnreachable, err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	host, port, err := net.SplitHostPort(cfg.AdminAddr)
+	if err != nil {
+		return fmt.Errorf("invalid admin-addr: %v", err)
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	body, err := json.Marshal(peer)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://"+net.JoinHostPort(host, port)+"/api/peers", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errAdminUnreachable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		var reply struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&reply) != nil || reply.Error == "" {
+			reply.Error = resp.Status
+		}
+		return fmt.Errorf("admin API: %s", reply.Error)
+	}
+	return nil
+}
+
+// serverPin returns the pin of the certificate the server presents, creating
+// the self-signed one it would create on start.
+func serverPin(cfg *config.Config) (string, error) {
+	certFile, keyFile := cfg.TLSCert, cfg.TLSKey
+	if certFile == "" || keyFile == "" {
+		certFile = filepath.Join(cfg.DataDir, "server.crt")
+		keyFile = filepath.Join(cfg.DataDir, "server.key")
+		hostname, _ := os.Hostname()
+		if err := crypto.LoadOrCreateSelfSigned(certFile, keyFile, []string{hostname}); err != nil {
+			return "", err
+		}
+	}
+	certs, err := crypto.NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return "", err
+	}
+	return certs.Pin(), nil
+}
+
+func runCA(args []string) {
+	fs := flag.NewFlagSet("ca", flag.ExitOnError)
+	dataDir := fs.String("data-dir", "/var/lib/govpn", "Directory for persistent server state")
+	ip := fs.String("ip", "", "Tunnel IP assigned to the peer (issue only)")
+	out := fs.String("out", ".", "Directory to write the client certificate to (issue only)")
+	days := fs.Int("days", 365, "Certificate validity in days (issue only)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s ca <issue|revoke|list> [options] [name]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	command := args[0]
+	fs.Parse(args[1:])
+	ca, err := crypto.LoadOrCreateCA(filepath.Join(*dataDir, "ca"))
+	if err != nil {
+		logrus.Fatalf("Failed to load CA: %v", err)
+	}
+	peersFile := config.PeersFile(*dataDir)
+	switch command {
+	case "issue":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		name := fs.Arg(0)
+		certPEM, keyPEM, err := ca.Issue(name, time.Duration(*days)*24*time.Hour)
+		if err != nil {
+			logrus.Fatalf("Failed to issue certificate: %v", err)
+		}
+		files := map[string][]byte{
+			name + ".crt": certPEM,
+			name + ".key": keyPEM,
+			"ca.crt":      ca.CertPEM(),
+		}
+		for file, data := range files {
+			if err := os.WriteFile(filepath.Join(*out, file), data, 0600); err != nil {
+				logrus.Fatalf("Failed to write %s: %v", file, err)
+			}
+		}
+		peers, err := config.LoadPeers(peersFile)
+		if err != nil {
+			logrus.Fatalf("Failed to load peers: %v", err)
+		}
+		ipSet := false
+		fs.Visit(func(f *flag.Flag) { ipSet = ipSet || f.Name == "ip" })
+		if peer := config.FindPeer(peers, name); peer != nil {
+			// an existing peer keeps its reserved IP unless -ip is given
+			if ipSet {
+				peer.IP = *ip
+			}
+			peer.Disabled = false
+		} else {
+			peers = append(peers, config.Peer{Name: name, IP: *ip})
+		}
+		if err := config.SavePeers(peersFile, peers); err != nil {
+			logrus.Fatalf("Failed to save peers: %v", err)
+		}
+		fmt.Printf("Issued certificate for %s in %s\n", name, *out)
+	case "revoke":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		if err := ca.Revoke(fs.Arg(0)); err != nil {
+			logrus.Fatalf("Failed to revoke certificate: %v", err)
+		}
+		fmt.Printf("Revoked certificates for %s\n", fs.Arg(0))
+	case "list":
+		issued, err := ca.List()
+		if err != nil {
+			logrus.Fatalf("Failed to list certificates: %v", err)
+		}
+		for _, cert := range issued {
+			status := "valid"
+			if cert.Revoked {
+				status = "revoked"
+			} else if time.Now().After(cert.NotAfter) {
+				status = "expired"
+			}
+			fmt.Printf("%-20s %-34s %s %s\n", cert.Name, cert.Serial, cert.NotAfter.Format("2006-01-02"), status)
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
 func init() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "GoVPN Server v1.0\n\n")
@@ -75,5 +587,10 @@ func init() {
 		flag.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nExample:\n")
 		fmt.Fprintf(os.Stderr, "  sudo %s -listen :9999 -ip 10.0.0.1 -subnet 10.0.0.0/24\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nCommands:\n")
+		fmt.Fprintf(os.Stderr, "  ca <issue|revoke|list>  Manage client certificates for -mtls\n")
+		fmt.Fprintf(os.Stderr, "  config check <file>     Validate a configuration file\n")
+		fmt.Fprintf(os.Stderr, "  keygen [-out file]      Generate a shared key\n")
+		fmt.Fprintf(os.Stderr, "  peer add <name>         Add a peer and print its client profile\n")
 	}
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+	"vpn/client"
+	"vpn/control"
+)
+
+func main() {
+	socket := flag.String("socket", control.DefaultSocket, "Control socket of the running client")
+	raw := flag.Bool("json", false, "Print raw JSON results")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <command> [args]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		fmt.Fprintf(os.Stderr, "  status              Show connection state\n")
+		fmt.Fprintf(os.Stderr, "  stats               Show traffic counters\n")
+		fmt.Fprintf(os.Stderr, "  reconnect           Drop and re-establish the connection\n")
+		fmt.Fprintf(os.Stderr, "  disconnect          Disconnect and stop the client\n")
+		fmt.Fprintf(os.Stderr, "  log <level>         Change the log level\n")
+		fmt.Fprintf(os.Stderr, "  switch <profile>    Connect using another profile\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	conn, err := control.Dial(*socket)
+	if err != nil {
+		fatal(err)
+	}
+	defer conn.Close()
+
+	command, args := flag.Arg(0), flag.Args()[1:]
+	switch command {
+	case "status":
+		var status client.Status
+		call(conn, "status", nil, &status, *raw)
+		if !*raw {
+			fmt.Printf("State:     %s\n", status.State)
+			if status.Profile != "" {
+				fmt.Printf("Profile:   %s\n", status.Profile)
+			}
+			fmt.Printf("Server:    %s (%s)\n", status.Server, status.Endpoint)
+			fmt.Printf("Tunnel IP: %s\n", status.IP)
+			if status.IP6 != "" {
+				fmt.Printf("Tunnel IPv6: %s\n", status.IP6)
+			}
+			if !status.ConnectedSince.IsZero() {
+				fmt.Printf("Connected: %s\n", time.Since(status.ConnectedSince).Round(time.Second))
+			}
+			if status.RTT > 0 {
+				fmt.Printf("RTT:       %.1f ms (jitter %.1f ms)\n", status.RTT, status.Jitter)
+			}
+			fmt.Printf("Traffic:   %d bytes in, %d bytes out\n", status.BytesIn, status.BytesOut)
+			if len(status.Endpoints) > 0 {
+				fmt.Println("Endpoints:")
+				for _, endpoint := range status.Endpoints {
+					result := fmt.Sprintf("%.1f ms", endpoint.Latency)
+					if endpoint.Error != "" {
+						result = endpoint.Error
+					}
+					fmt.Printf("  %-30s %s\n", endpoint.Server, result)
+				}
+			}
+		}
+	case "stats":
+		var stats client.Stats
+		call(conn, "stats", nil, &stats, *raw)
+		if !*raw {
+			fmt.Printf("IN: %d bytes, OUT: %d bytes\n", stats.BytesIn, stats.BytesOut)
+		}
+	case "reconnect", "disconnect":
+		call(conn, command, nil, nil, *raw)
+	case "log":
+		if len(args) != 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		call(conn, "log_level", map[string]string{"level": args[0]}, nil, *raw)
+	case "switch":
+		if len(args) != 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		call(conn, "switch_profile", map[string]string{"profile": args[0]}, nil, *raw)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", command)
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func call(conn *control.Client, method string, params, result interface{}, raw bool) {
+	var data json.RawMessage
+	if err := conn.Call(method, params, &data); err != nil {
+		fatal(err)
+	}
+	if raw {
+		if len(data) > 0 {
+			fmt.Println(string(data))
+		}
+		return
+	}
+	if result != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, result); err != nil {
+			fatal(err)
+		}
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "vpnctl: %v\n", err)
+	os.Exit(1)
+}
@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"time"
+)
+
+const Namespace = "govpn"
+
+// RTTBuckets cover keepalive round trips from 1ms to about 16s.
+var RTTBuckets = prometheus.ExponentialBuckets(0.001, 2, 15)
+
+// Serve exposes registry as /metrics on its own listener.
+func Serve(addr string, registry *prometheus.Registry) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("metrics listener: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go server.Serve(listener)
+	logrus.Infof("Metrics listening on http://%s/metrics", listener.Addr())
+	return server, nil
+}
@@ -0,0 +1,279 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	dnsBackendResolved     = "systemd-resolved"
+	dnsBackendResolvconf   = "resolvconf"
+	dnsBackendFile         = "file"
+	dnsBackendNetworksetup = "networksetup"
+
+	resolvConf = "/etc/resolv.conf"
+)
+
+// dnsState is written to disk before the system DNS configuration is touched,
+// so a later run can undo the change after a crash.
+type dnsState struct {
+	Backend    string              `json:"backend"`
+	Link       string              `json:"link,omitempty"`
+	Symlink    string              `json:"symlink,omitempty"`
+	ResolvConf []byte              `json:"resolv_conf,omitempty"`
+	Services   map[string][]string `json:"services,omitempty"`
+}
+
+type DNSManager struct {
+	tunName   string
+	stateFile string
+	state     *dnsState
+	journal   *Journal
+}
+
+func NewDNSManager(tunName, stateFile string) *DNSManager {
+	return &DNSManager{
+		tunName:   tunName,
+		stateFile: stateFile,
+	}
+}
+
+func (m *DNSManager) SetJournal(journal *Journal) {
+	m.journal = journal
+}
+
+func detectDNSBackend() string {
+	switch runtime.GOOS {
+	case "linux":
+		target, _ := filepath.EvalSymlinks(resolvConf)
+		if strings.Contains(target, "systemd/resolve") {
+			return dnsBackendResolved
+		}
+		if _, err := exec.LookPath("resolvconf"); err == nil {
+			return dnsBackendResolvconf
+		}
+		return dnsBackendFile
+	case "darwin":
+		return dnsBackendNetworksetup
+	default:
+		return ""
+	}
+}
+
+// Apply points the system resolver at servers. domains are routing domains
+// for systemd-resolved ("corp.example" sends only that zone to servers); with
+// no domains all queries go to servers.
+func (m *DNSManager) Apply(servers, domains []string) error {
+	if len(servers) == 0 {
+		return nil
+	}
+	state := &dnsState{Backend: detectDNSBackend(), Link: m.tunName}
+	if state.Backend == "" {
+		return fmt.Errorf("DNS configuration is not supported on %s", runtime.GOOS)
+	}
+	if len(domains) > 0 && state.Backend != dnsBackendResolved {
+		logrus.Warnf("DNS routing domains need systemd-resolved, %s applies %v to all queries", state.Backend, servers)
+	}
+	switch state.Backend {
+	case dnsBackendFile:
+		info, err := os.Lstat(resolvConf)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			state.Symlink, _ = os.Readlink(resolvConf)
+		} else if state.ResolvConf, err = os.ReadFile(resolvConf); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("read %s: %v", resolvConf, err)
+		}
+	case dnsBackendNetworksetup:
+		state.Services = make(map[string][]string)
+		for _, service := range networkServices() {
+			state.Services[service] = currentServiceDNS(service)
+		}
+	}
+	if err := m.saveState(state); err != nil {
+		return fmt.Errorf("save DNS state: %v", err)
+	}
+	if err := m.journal.RecordDNS(m.stateFile); err != nil {
+		return err
+	}
+	m.state = state
+	logrus.Infof("Configuring DNS %v via %s (was %v)", servers, state.Backend, currentDNS())
+
+	switch state.Backend {
+	case dnsBackendResolved:
+		manager, err := newResolvedManager()
+		if err != nil {
+			return err
+		}
+		ifindex, err := linkIndex(m.tunName)
+		if err != nil {
+			return err
+		}
+		return applyResolved(manager, ifindex, servers, domains)
+	case dnsBackendResolvconf:
+		cmd := exec.Command("resolvconf", "-a", m.tunName+".govpn")
+		cmd.Stdin = strings.NewReader(nameservers(servers))
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("resolvconf: %v: %s", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	case dnsBackendFile:
+		if state.Symlink != "" {
+			os.Remove(resolvConf)
+		}
+		return os.WriteFile(resolvConf, []byte(nameservers(servers)), 0644)
+	case dnsBackendNetworksetup:
+		for service := range state.Services {
+			if err := runCommand("networksetup", append([]string{"-setdnsservers", service}, servers...)...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *DNSManager) Restore() error {
+	if m.state == nil {
+		return nil
+	}
+	err := restoreDNSState(m.state)
+	if err == nil {
+		os.Remove(m.stateFile)
+		m.state = nil
+	}
+	return err
+}
+
+// RestoreDNSState undoes a DNS change left behind by a previous run that did
+// not shut down cleanly.
+func RestoreDNSState(stateFile string) error {
+	data, err := os.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state := &dnsState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return fmt.Errorf("parse %s: %v", stateFile, err)
+	}
+	logrus.Warnf("Restoring DNS configuration left by a previous run (%s)", state.Backend)
+	if err := restoreDNSState(state); err != nil {
+		return err
+	}
+	return os.Remove(stateFile)
+}
+
+func restoreDNSState(state *dnsState) error {
+	switch state.Backend {
+	case dnsBackendResolved:
+		// the link disappears together with the TUN device after a crash
+		if ifindex, err := linkIndex(state.Link); err == nil {
+			if manager, err := newResolvedManager(); err == nil {
+				_ = manager.RevertLink(ifindex)
+			}
+		}
+	case dnsBackendResolvconf:
+		_ = exec.Command("resolvconf", "-d", state.Link+".govpn").Run()
+	case dnsBackendFile:
+		if state.Symlink != "" {
+			os.Remove(resolvConf)
+			return os.Symlink(state.Symlink, resolvConf)
+		}
+		if state.ResolvConf != nil {
+			return os.WriteFile(resolvConf, state.ResolvConf, 0644)
+		}
+	case dnsBackendNetworksetup:
+		for service, servers := range state.Services {
+			if len(servers) == 0 {
+				servers = []string{"Empty"}
+			}
+			if err := runCommand("networksetup", append([]string{"-setdnsservers", service}, servers...)...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *DNSManager) saveState(state *dnsState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.stateFile), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(m.stateFile, data, 0600)
+}
+
+func nameservers(servers []string) string {
+	var content bytes.Buffer
+	content.WriteString("# generated by vpn-client\n")
+	for _, server := range servers {
+		fmt.Fprintf(&content, "nameserver %s\n", server)
+	}
+	return content.String()
+}
+
+func networkServices() []string {
+	var services []string
+	output, _ := exec.Command("networksetup", "-listallnetworkservices").Output()
+	for _, service := range strings.Split(string(output), "\n") {
+		service = strings.TrimSpace(service)
+		if service != "" && !strings.Contains(service, "*") {
+			services = append(services, service)
+		}
+	}
+	return services
+}
+
+func currentServiceDNS(service string) []string {
+	var servers []string
+	output, err := exec.Command("networksetup", "-getdnsservers", service).Output()
+	if err != nil {
+		return nil
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.Contains(line, " ") {
+			servers = append(servers, line)
+		}
+	}
+	return servers
+}
+
+func currentDNS() []string {
+	var dns []string
+	switch runtime.GOOS {
+	case "linux":
+		data, err := os.ReadFile(resolvConf)
+		if err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				fields := strings.Fields(line)
+				if len(fields) >= 2 && fields[0] == "nameserver" {
+					dns = append(dns, fields[1])
+				}
+			}
+		}
+	case "darwin":
+		out, err := exec.Command("scutil", "--dns").Output()
+		if err == nil {
+			for _, line := range strings.Split(string(out), "\n") {
+				if strings.Contains(line, "nameserver") {
+					fields := strings.Fields(line)
+					if len(fields) >= 3 {
+						dns = append(dns, fields[2])
+					}
+				}
+			}
+		}
+	}
+	return dns
+}
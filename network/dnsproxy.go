@@ -0,0 +1,261 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"vpn/protocol"
+)
+
+const minRouteTTL = time.Minute
+
+type HostRouter interface {
+	AddHostRoute(ip string) error
+	DeleteHostRoute(ip string) error
+}
+
+type DNSInterceptor struct {
+	listenAddr string
+	router     HostRouter
+	rules      []string
+	tunnelDNS  []string
+	upstreams  []string
+	ipv6       bool
+
+	conn     *net.UDPConn
+	routes   map[string]time.Time
+	mu       sync.Mutex
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewDNSInterceptor creates a DNS stub that sends queries matching rules to
+// tunnelDNS and everything else to upstreams, and routes the addresses in
+// matching answers through the tunnel until their TTL expires.
+func NewDNSInterceptor(listenAddr string, router HostRouter, rules, tunnelDNS, upstreams []string) *DNSInterceptor {
+	if len(upstreams) == 0 {
+		upstreams = tunnelDNS
+	}
+	return &DNSInterceptor{
+		listenAddr: listenAddr,
+		router:     router,
+		rules:      rules,
+		tunnelDNS:  tunnelDNS,
+		upstreams:  upstreams,
+		routes:     make(map[string]time.Time),
+		stopChan:   make(chan struct{}),
+	}
+}
+
+// SetIPv6 makes AAAA answers routed through the tunnel too.
+func (d *DNSInterceptor) SetIPv6(enabled bool) {
+	d.ipv6 = enabled
+}
+
+func (d *DNSInterceptor) Start() error {
+	addr, err := net.ResolveUDPAddr("udp", d.listenAddr)
+	if err != nil {
+		return fmt.Errorf("resolve listen address: %v", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %v", d.listenAddr, err)
+	}
+	d.conn = conn
+	d.wg.Add(2)
+	go d.serve()
+	go d.routeExpirer()
+	logrus.Infof("DNS interceptor listening on %s for %v", d.listenAddr, d.rules)
+	return nil
+}
+
+func (d *DNSInterceptor) serve() {
+	defer d.wg.Done()
+	buffer := make([]byte, 4096)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-d.stopChan:
+				return
+			default:
+				logrus.Errorf("DNS interceptor read error: %v", err)
+				continue
+			}
+		}
+		query := append([]byte{}, buffer[:n]...)
+		// Stop waits for the handlers so none adds a route after cleanup
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.handle(query, addr)
+		}()
+	}
+}
+
+func (d *DNSInterceptor) handle(query []byte, addr *net.UDPAddr) {
+	msg, err := protocol.ParseDNSMessage(query)
+	if err != nil {
+		logrus.Debugf("Dropping invalid DNS query from %s: %v", addr, err)
+		return
+	}
+	servers := d.upstreams
+	matched := d.matches(msg.Question)
+	if matched {
+		servers = d.tunnelDNS
+	}
+	response, err := forwardDNS(query, servers)
+	if err != nil {
+		logrus.Warnf("Failed to resolve %s: %v", msg.Question, err)
+		return
+	}
+	if matched {
+		if answer, err := protocol.ParseDNSMessage(response); err == nil {
+			for _, record := range answer.Answers {
+				if record.Type == protocol.DNSTypeA || (record.Type == protocol.DNSTypeAAAA && d.ipv6) {
+					d.addHostRoute(record.IP, record.TTL)
+				}
+			}
+		}
+	}
+	select {
+	case <-d.stopChan:
+		return
+	default:
+	}
+	if _, err := d.conn.WriteToUDP(response, addr); err != nil {
+		logrus.Debugf("Failed to answer DNS query from %s: %v", addr, err)
+	}
+}
+
+func (d *DNSInterceptor) matches(name string) bool {
+	for _, rule := range d.rules {
+		if protocol.MatchDomain(rule, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardDNS asks servers in turn until one answers. A reply truncated to
+// fit a datagram is fetched again over TCP, so all addresses get routed.
+func forwardDNS(query []byte, servers []string) ([]byte, error) {
+	err := errors.New("no DNS servers configured")
+	for _, server := range servers {
+		var response []byte
+		if response, err = exchangeDNS("udp", server, query); err != nil {
+			continue
+		}
+		if msg, parseErr := protocol.ParseDNSMessage(response); parseErr != nil || !msg.Truncated {
+			return response, nil
+		}
+		if response, err = exchangeDNS("tcp", server, query); err == nil {
+			return response, nil
+		}
+		err = fmt.Errorf("truncated reply from %s, TCP retry failed: %v", server, err)
+	}
+	return nil, err
+}
+
+func exchangeDNS(network, server string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, net.JoinHostPort(server, "53"), 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buffer := make([]byte, 4096)
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		return buffer[:n], nil
+	}
+	// over TCP every message is prefixed with its length
+	framed := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	if _, err := conn.Write(append(framed, query...)); err != nil {
+		return nil, err
+	}
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	response := make([]byte, length)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (d *DNSInterceptor) addHostRoute(ip net.IP, ttl time.Duration) {
+	if ttl < minRouteTTL {
+		ttl = minRouteTTL
+	}
+	key := ip.String()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.routes[key]; !ok {
+		if err := d.router.AddHostRoute(key); err != nil {
+			logrus.Warnf("Failed to route %s through the tunnel: %v", key, err)
+			return
+		}
+		logrus.Debugf("Routing %s through the tunnel for %v", key, ttl)
+	}
+	expires := time.Now().Add(ttl)
+	if expires.After(d.routes[key]) {
+		d.routes[key] = expires
+	}
+}
+
+func (d *DNSInterceptor) removeHostRoute(ip string) {
+	if err := d.router.DeleteHostRoute(ip); err != nil {
+		logrus.Debugf("Failed to remove route for %s: %v", ip, err)
+	}
+}
+
+func (d *DNSInterceptor) routeExpirer() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stopChan:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			d.mu.Lock()
+			for ip, expires := range d.routes {
+				if now.After(expires) {
+					d.removeHostRoute(ip)
+					delete(d.routes, ip)
+					logrus.Debugf("Route for %s expired", ip)
+				}
+			}
+			d.mu.Unlock()
+		}
+	}
+}
+
+func (d *DNSInterceptor) Stop() {
+	close(d.stopChan)
+	if d.conn != nil {
+		d.conn.Close()
+	}
+	d.wg.Wait()
+	d.mu.Lock()
+	for ip := range d.routes {
+		d.removeHostRoute(ip)
+	}
+	d.routes = make(map[string]time.Time)
+	d.mu.Unlock()
+}
@@ -0,0 +1,198 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type journalEntry struct {
+	Action   string   `json:"action"`
+	Undo     []string `json:"undo,omitempty"`
+	DNSState string   `json:"dns_state,omitempty"`
+}
+
+// Journal records how to undo every change made to the host before the change
+// is applied, so a client killed with SIGKILL can be cleaned up by the next
+// run. A nil Journal records nothing.
+type Journal struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewJournal(path string) *Journal {
+	return &Journal{path: path}
+}
+
+func (j *Journal) Record(action string, undo ...string) error {
+	return j.append(journalEntry{Action: action, Undo: undo})
+}
+
+func (j *Journal) RecordDNS(stateFile string) error {
+	return j.append(journalEntry{Action: "configure DNS", DNSState: stateFile})
+}
+
+func (j *Journal) append(entry journalEntry) error {
+	if j == nil {
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("open journal: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("write journal: %v", err)
+	}
+	return file.Sync()
+}
+
+func (j *Journal) entries() ([]journalEntry, error) {
+	file, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []journalEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry journalEntry
+		// a torn last line from a crash mid-write is skipped
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			logrus.Warnf("Skipping corrupt journal entry: %v", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Forget drops the latest entry recorded with undo once the change was
+// reverted while the client runs, so the journal only holds what is applied.
+func (j *Journal) Forget(undo ...string) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries, err := j.entries()
+	if err != nil {
+		return err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if strings.Join(entries[i].Undo, "\x00") == strings.Join(undo, "\x00") {
+			return j.rewrite(append(entries[:i], entries[i+1:]...))
+		}
+	}
+	return nil
+}
+
+// rewrite replaces the journal with entries; a crash leaves the old or the new
+// file, never a mix.
+func (j *Journal) rewrite(entries []journalEntry) error {
+	if len(entries) == 0 {
+		return j.clear()
+	}
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(data, '\n'))
+	}
+	tmp := j.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("rewrite journal: %v", err)
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return fmt.Errorf("rewrite journal: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("rewrite journal: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("rewrite journal: %v", err)
+	}
+	return os.Rename(tmp, j.path)
+}
+
+func (j *Journal) Pending() (int, error) {
+	if j == nil {
+		return 0, nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries, err := j.entries()
+	return len(entries), err
+}
+
+// Replay undoes all recorded changes in reverse order and empties the
+// journal. Undo steps that fail, e.g. because the change was already reverted,
+// are logged and skipped.
+func (j *Journal) Replay() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries, err := j.entries()
+	if err != nil {
+		return fmt.Errorf("read journal: %v", err)
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		logrus.Infof("Reverting: %s", entry.Action)
+		if entry.DNSState != "" {
+			if err := RestoreDNSState(entry.DNSState); err != nil {
+				logrus.Warnf("Failed to restore DNS: %v", err)
+			}
+			continue
+		}
+		if len(entry.Undo) == 0 {
+			continue
+		}
+		if output, err := exec.Command(entry.Undo[0], entry.Undo[1:]...).CombinedOutput(); err != nil {
+			logrus.Debugf("Undo %s failed: %v: %s", strings.Join(entry.Undo, " "), err, strings.TrimSpace(string(output)))
+		}
+	}
+	return j.clear()
+}
+
+func (j *Journal) Clear() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.clear()
+}
+
+func (j *Journal) clear() error {
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package network
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalForget(t *testing.T) {
+	journal := NewJournal(filepath.Join(t.TempDir(), "journal"))
+	if err := journal.Record("add a", "del", "a"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := journal.Record("add b", "del", "b"); err != nil {
+			t.Fatal(err)
+		}
+		if err := journal.Forget("del", "b"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := journal.entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Action != "add a" {
+		t.Fatalf("entries = %+v, want only add a", entries)
+	}
+	if err := journal.Forget("del", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := journal.Pending(); err != nil || pending != 0 {
+		t.Fatalf("pending = %d, %v, want 0", pending, err)
+	}
+}
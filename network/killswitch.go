@@ -0,0 +1,191 @@
+package network
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const killSwitchChain = "GOVPN-KILLSWITCH"
+
+type KillSwitch struct {
+	tunName   string
+	endpoints []string
+	allowLAN  []string
+	journal   *Journal
+	enabled   bool
+}
+
+func NewKillSwitch(tunName string, endpoints []string, allowLAN []string) *KillSwitch {
+	return &KillSwitch{
+		tunName:   tunName,
+		endpoints: endpoints,
+		allowLAN:  allowLAN,
+	}
+}
+
+func (k *KillSwitch) SetJournal(journal *Journal) {
+	k.journal = journal
+}
+
+// MoveJournal makes journal record the kill switch from now on. A journal
+// kept in another file gets the steps to remove it right away.
+func (k *KillSwitch) MoveJournal(journal *Journal) error {
+	same := k.journal != nil && journal != nil && k.journal.path == journal.path
+	k.journal = journal
+	if same {
+		return nil
+	}
+	return k.Record()
+}
+
+// Record journals how to remove the kill switch, for a journal that was
+// cleared while the kill switch stays up.
+func (k *KillSwitch) Record() error {
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		if err := recordChain(k.journal, bin, killSwitchChain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update swaps the rules of the enabled kill switch for ones that pass
+// tunName, endpoints and allowLAN. Traffic outside them stays blocked while
+// the rules change. An empty tunName keeps the current interface.
+func (k *KillSwitch) Update(tunName string, endpoints, allowLAN []string) error {
+	if tunName != "" {
+		k.tunName = tunName
+	}
+	k.endpoints, k.allowLAN = endpoints, allowLAN
+	// the journal already holds the steps to remove the chains
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		if err := k.install(bin, nil); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Kill switch updated, only %s, loopback and %v are reachable", k.tunName, k.endpoints)
+	return nil
+}
+
+func (k *KillSwitch) Enable() error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("kill switch is not supported on %s", runtime.GOOS)
+	}
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		if err := k.install(bin, k.journal); err != nil {
+			k.Disable()
+			return err
+		}
+	}
+	k.enabled = true
+	logrus.Infof("Kill switch enabled, only %s, loopback and %v are reachable", k.tunName, k.endpoints)
+	return nil
+}
+
+func (k *KillSwitch) install(bin string, journal *Journal) error {
+	ipv6 := bin == "ip6tables"
+	rules := [][]string{
+		{"-o", "lo", "-j", "ACCEPT"},
+		{"-o", k.tunName, "-j", "ACCEPT"},
+	}
+	for _, endpoint := range k.endpoints {
+		host, port, err := net.SplitHostPort(endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid endpoint %s: %v", endpoint, err)
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || (ip.To4() == nil) != ipv6 {
+			continue
+		}
+		rules = append(rules, []string{"-d", ip.String(), "-p", "tcp", "--dport", port, "-j", "ACCEPT"})
+	}
+	for _, cidr := range k.allowLAN {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid LAN range %s: %v", cidr, err)
+		}
+		if (network.IP.To4() == nil) != ipv6 {
+			continue
+		}
+		rules = append(rules, []string{"-d", network.String(), "-j", "ACCEPT"})
+	}
+	if !ipv6 {
+		// keep DHCP leases alive on the physical interface
+		rules = append(rules, []string{"-p", "udp", "--dport", "67:68", "-j", "ACCEPT"})
+	}
+	rules = append(rules, []string{"-j", "REJECT"})
+	return installChain(journal, bin, killSwitchChain, rules)
+}
+
+// installChain creates chain with rules, or replaces the rules of an existing
+// one, and hooks it in front of OUTPUT.
+func installChain(journal *Journal, bin, chain string, rules [][]string) error {
+	if err := recordChain(journal, bin, chain); err != nil {
+		return err
+	}
+	existing := 0
+	if output, err := exec.Command(bin, "-S", chain).Output(); err != nil {
+		if err := runCommand(bin, "-N", chain); err != nil {
+			return err
+		}
+	} else {
+		existing = strings.Count(string(output), "\n-A ")
+	}
+	// the new rules go in front of the old ones, which are deleted after,
+	// so a hooked chain never lets traffic through while it changes
+	for i, rule := range rules {
+		if err := runCommand(bin, append([]string{"-I", chain, strconv.Itoa(i + 1)}, rule...)...); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < existing; i++ {
+		if err := runCommand(bin, "-D", chain, strconv.Itoa(len(rules)+1)); err != nil {
+			return err
+		}
+	}
+	if exec.Command(bin, "-C", "OUTPUT", "-j", chain).Run() != nil {
+		if err := runCommand(bin, "-I", "OUTPUT", "1", "-j", chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func recordChain(journal *Journal, bin, chain string) error {
+	// recorded in creation order so a replay unhooks, flushes, then deletes
+	undo := [][]string{
+		{bin, "-X", chain},
+		{bin, "-F", chain},
+		{bin, "-D", "OUTPUT", "-j", chain},
+	}
+	for _, cmd := range undo {
+		if err := journal.Record(chain+" ("+bin+")", cmd...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeChain(bin, chain string) {
+	// delete every jump in case the chain was hooked more than once
+	for exec.Command(bin, "-D", "OUTPUT", "-j", chain).Run() == nil {
+	}
+	_ = exec.Command(bin, "-F", chain).Run()
+	_ = exec.Command(bin, "-X", chain).Run()
+}
+
+func (k *KillSwitch) Disable() error {
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		removeChain(bin, killSwitchChain)
+	}
+	if k.enabled {
+		logrus.Info("Kill switch disabled")
+	}
+	k.enabled = false
+	return nil
+}
@@ -0,0 +1,73 @@
+package network
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+	"runtime"
+)
+
+const dnsGuardChain = "GOVPN-DNS"
+
+// DNSLeakGuard drops DNS queries to any resolver other than the tunnel
+// resolvers, so applications with hardcoded servers cannot bypass the tunnel.
+type DNSLeakGuard struct {
+	resolvers []string
+	journal   *Journal
+	enabled   bool
+}
+
+func NewDNSLeakGuard(resolvers []string) *DNSLeakGuard {
+	return &DNSLeakGuard{resolvers: resolvers}
+}
+
+func (g *DNSLeakGuard) SetJournal(journal *Journal) {
+	g.journal = journal
+}
+
+func (g *DNSLeakGuard) Enable() error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("DNS leak protection is not supported on %s", runtime.GOOS)
+	}
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		if err := g.install(bin); err != nil {
+			g.Disable()
+			return err
+		}
+	}
+	g.enabled = true
+	logrus.Infof("DNS leak protection enabled, only %v answer queries", g.resolvers)
+	return nil
+}
+
+func (g *DNSLeakGuard) install(bin string) error {
+	ipv6 := bin == "ip6tables"
+	// local stubs (systemd-resolved, the DNS interceptor) forward to the
+	// allowed resolvers themselves
+	rules := [][]string{{"-o", "lo", "-j", "RETURN"}}
+	for _, resolver := range g.resolvers {
+		ip := net.ParseIP(resolver)
+		if ip == nil {
+			return fmt.Errorf("invalid DNS server %s", resolver)
+		}
+		if (ip.To4() == nil) != ipv6 {
+			continue
+		}
+		rules = append(rules, []string{"-d", ip.String(), "-j", "RETURN"})
+	}
+	for _, proto := range []string{"udp", "tcp"} {
+		rules = append(rules, []string{"-p", proto, "--dport", "53", "-j", "DROP"})
+	}
+	return installChain(g.journal, bin, dnsGuardChain, rules)
+}
+
+func (g *DNSLeakGuard) Disable() error {
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		removeChain(bin, dnsGuardChain)
+	}
+	if g.enabled {
+		logrus.Info("DNS leak protection disabled")
+	}
+	g.enabled = false
+	return nil
+}
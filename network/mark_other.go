@@ -0,0 +1,11 @@
+//go:build !linux
+
+package network
+
+import (
+	"syscall"
+)
+
+func SocketMarkControl(mark int) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
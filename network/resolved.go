@@ -0,0 +1,110 @@
+package network
+
+import (
+	"fmt"
+	"github.com/godbus/dbus/v5"
+	"net"
+	"strings"
+)
+
+// address families as systemd-resolved expects them, the Linux values
+const (
+	afInet  = 2
+	afInet6 = 10
+)
+
+// resolvedManager is the part of the org.freedesktop.resolve1.Manager D-Bus
+// interface the client uses.
+type resolvedManager interface {
+	SetLinkDNS(ifindex int32, servers []resolvedAddress) error
+	SetLinkDomains(ifindex int32, domains []resolvedDomain) error
+	SetLinkDefaultRoute(ifindex int32, enable bool) error
+	RevertLink(ifindex int32) error
+}
+
+// resolvedAddress and resolvedDomain match the (iay) and (sb) structs of the
+// D-Bus methods.
+type resolvedAddress struct {
+	Family  int32
+	Address []byte
+}
+
+type resolvedDomain struct {
+	Domain      string
+	RoutingOnly bool
+}
+
+// newResolvedManager connects to systemd-resolved on the system bus.
+var newResolvedManager = func() (resolvedManager, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("connect to system bus: %v", err)
+	}
+	return &dbusResolved{object: conn.Object("org.freedesktop.resolve1", "/org/freedesktop/resolve1")}, nil
+}
+
+type dbusResolved struct {
+	object dbus.BusObject
+}
+
+func (r *dbusResolved) call(method string, args ...interface{}) error {
+	if err := r.object.Call("org.freedesktop.resolve1.Manager."+method, 0, args...).Err; err != nil {
+		return fmt.Errorf("systemd-resolved %s: %v", method, err)
+	}
+	return nil
+}
+
+func (r *dbusResolved) SetLinkDNS(ifindex int32, servers []resolvedAddress) error {
+	return r.call("SetLinkDNS", ifindex, servers)
+}
+
+func (r *dbusResolved) SetLinkDomains(ifindex int32, domains []resolvedDomain) error {
+	return r.call("SetLinkDomains", ifindex, domains)
+}
+
+func (r *dbusResolved) SetLinkDefaultRoute(ifindex int32, enable bool) error {
+	return r.call("SetLinkDefaultRoute", ifindex, enable)
+}
+
+func (r *dbusResolved) RevertLink(ifindex int32) error {
+	return r.call("RevertLink", ifindex)
+}
+
+func linkIndex(name string) (int32, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return int32(iface.Index), nil
+}
+
+// applyResolved sends the queries for domains, or all queries when there are
+// none, to servers over the link ifindex.
+func applyResolved(manager resolvedManager, ifindex int32, servers, domains []string) error {
+	var addresses []resolvedAddress
+	for _, server := range servers {
+		ip := net.ParseIP(strings.TrimSpace(server))
+		switch {
+		case ip == nil:
+			return fmt.Errorf("invalid DNS server %q", server)
+		case ip.To4() != nil:
+			addresses = append(addresses, resolvedAddress{Family: afInet, Address: ip.To4()})
+		default:
+			addresses = append(addresses, resolvedAddress{Family: afInet6, Address: ip.To16()})
+		}
+	}
+	if err := manager.SetLinkDNS(ifindex, addresses); err != nil {
+		return err
+	}
+	routing := []resolvedDomain{{Domain: ".", RoutingOnly: true}}
+	if len(domains) > 0 {
+		routing = nil
+		for _, domain := range domains {
+			routing = append(routing, resolvedDomain{Domain: strings.TrimPrefix(domain, "~"), RoutingOnly: true})
+		}
+	}
+	if err := manager.SetLinkDomains(ifindex, routing); err != nil {
+		return err
+	}
+	return manager.SetLinkDefaultRoute(ifindex, len(domains) == 0)
+}
@@ -0,0 +1,116 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+type fakeResolved struct {
+	servers      map[int32][]resolvedAddress
+	domains      map[int32][]resolvedDomain
+	defaultRoute map[int32]bool
+	reverted     []int32
+	fail         string
+}
+
+func newFakeResolved() *fakeResolved {
+	return &fakeResolved{
+		servers:      map[int32][]resolvedAddress{},
+		domains:      map[int32][]resolvedDomain{},
+		defaultRoute: map[int32]bool{},
+	}
+}
+
+func (f *fakeResolved) SetLinkDNS(ifindex int32, servers []resolvedAddress) error {
+	if f.fail == "SetLinkDNS" {
+		return errors.New("access denied")
+	}
+	f.servers[ifindex] = servers
+	return nil
+}
+
+func (f *fakeResolved) SetLinkDomains(ifindex int32, domains []resolvedDomain) error {
+	if f.fail == "SetLinkDomains" {
+		return errors.New("access denied")
+	}
+	f.domains[ifindex] = domains
+	return nil
+}
+
+func (f *fakeResolved) SetLinkDefaultRoute(ifindex int32, enable bool) error {
+	f.defaultRoute[ifindex] = enable
+	return nil
+}
+
+func (f *fakeResolved) RevertLink(ifindex int32) error {
+	f.reverted = append(f.reverted, ifindex)
+	return nil
+}
+
+func TestApplyResolvedAllQueries(t *testing.T) {
+	fake := newFakeResolved()
+	if err := applyResolved(fake, 7, []string{"10.0.0.1", "fd00::1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	wantServers := []resolvedAddress{
+		{Family: afInet, Address: net.ParseIP("10.0.0.1").To4()},
+		{Family: afInet6, Address: net.ParseIP("fd00::1").To16()},
+	}
+	if !reflect.DeepEqual(fake.servers[7], wantServers) {
+		t.Errorf("servers = %v, want %v", fake.servers[7], wantServers)
+	}
+	wantDomains := []resolvedDomain{{Domain: ".", RoutingOnly: true}}
+	if !reflect.DeepEqual(fake.domains[7], wantDomains) {
+		t.Errorf("domains = %v, want %v", fake.domains[7], wantDomains)
+	}
+	if !fake.defaultRoute[7] {
+		t.Error("link is not the default route")
+	}
+}
+
+func TestApplyResolvedRoutingDomains(t *testing.T) {
+	fake := newFakeResolved()
+	if err := applyResolved(fake, 3, []string{"10.0.0.1"}, []string{"corp.example", "~lab.example"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []resolvedDomain{{Domain: "corp.example", RoutingOnly: true}, {Domain: "lab.example", RoutingOnly: true}}
+	if !reflect.DeepEqual(fake.domains[3], want) {
+		t.Errorf("domains = %v, want %v", fake.domains[3], want)
+	}
+	if fake.defaultRoute[3] {
+		t.Error("link with routing domains is the default route")
+	}
+}
+
+func TestApplyResolvedErrors(t *testing.T) {
+	fake := newFakeResolved()
+	if err := applyResolved(fake, 1, []string{"not-an-ip"}, nil); err == nil {
+		t.Error("invalid server accepted")
+	}
+	fake.fail = "SetLinkDomains"
+	if err := applyResolved(fake, 1, []string{"10.0.0.1"}, nil); err == nil {
+		t.Error("SetLinkDomains failure not reported")
+	}
+	if _, ok := fake.defaultRoute[1]; ok {
+		t.Error("default route set after a failure")
+	}
+}
+
+func TestRestoreResolvedRevertsLink(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface named lo")
+	}
+	fake := newFakeResolved()
+	saved := newResolvedManager
+	newResolvedManager = func() (resolvedManager, error) { return fake, nil }
+	defer func() { newResolvedManager = saved }()
+	if err := restoreDNSState(&dnsState{Backend: dnsBackendResolved, Link: "lo"}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fake.reverted, []int32{int32(lo.Index)}) {
+		t.Errorf("reverted %v, want [%d]", fake.reverted, lo.Index)
+	}
+}
@@ -4,25 +4,131 @@ import (
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"net"
+	"os"
 	"os/exec"
 	"runtime"
 	"strings"
+	"sync"
 )
 
 type RouteManager struct {
-	tunName     string
-	serverIP    string
-	originalGW  string
-	originalDNS []string
-	vpnDNS      []string
+	tunName    string
+	endpoints  []string
+	originalGW string
+
+	includeRoutes []string
+	excludeRoutes []string
+	addedRoutes   [][]string
+
+	table     int
+	mark      int
+	ipv6      bool
+	blockIPv6 bool
+	journal   *Journal
+	mu        sync.Mutex
 }
 
-func NewRouteManager(tunName, serverIP string, vpnDNS []string) *RouteManager {
+// NewRouteManager keeps the server endpoints (host:port) reachable through
+// the original gateway, so the client can fail over between them.
+func NewRouteManager(tunName string, endpoints []string) *RouteManager {
 	return &RouteManager{
-		tunName:  tunName,
-		serverIP: serverIP,
-		vpnDNS:   vpnDNS,
+		tunName:   tunName,
+		endpoints: endpoints,
+	}
+}
+
+func (r *RouteManager) endpointHosts() []string {
+	hosts := make([]string, 0, len(r.endpoints))
+	for _, endpoint := range r.endpoints {
+		host, _, _ := net.SplitHostPort(endpoint)
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// SetSplitRoutes limits the tunnel to the include CIDRs (all traffic when
+// empty) and sends the exclude CIDRs through the original gateway.
+func (r *RouteManager) SetSplitRoutes(include, exclude []string) error {
+	for _, cidr := range append(append([]string{}, include...), exclude...) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid route %s: %v", cidr, err)
+		}
 	}
+	r.includeRoutes = include
+	r.excludeRoutes = exclude
+	return nil
+}
+
+// SetPolicyRouting makes Linux keep all tunnel routes in table and send every
+// packet without mark there, leaving the main table untouched.
+func (r *RouteManager) SetPolicyRouting(table, mark int) {
+	r.table = table
+	r.mark = mark
+}
+
+// SetBlockIPv6 makes all IPv6 destinations unreachable while connected, so
+// dual-stack hosts cannot leak around an IPv4-only tunnel.
+func (r *RouteManager) SetBlockIPv6(block bool) {
+	r.blockIPv6 = block
+}
+
+// SetIPv6 sends IPv6 through the tunnel as well, for servers that assigned
+// the client an IPv6 address.
+func (r *RouteManager) SetIPv6(enabled bool) {
+	r.ipv6 = enabled
+}
+
+// SetJournal makes every route change recorded in journal before it is made.
+func (r *RouteManager) SetJournal(journal *Journal) {
+	r.journal = journal
+}
+
+func (r *RouteManager) tunnelRoutes() []string {
+	if len(r.includeRoutes) > 0 {
+		return r.includeRoutes
+	}
+	routes := []string{"0.0.0.0/1", "128.0.0.0/1"}
+	if r.ipv6 {
+		routes = append(routes, "::/1", "8000::/1")
+	}
+	return routes
+}
+
+// addRoute runs add and remembers del so RestoreRoutes removes exactly the
+// routes that were installed.
+func (r *RouteManager) addRoute(add, del []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.journal.Record(strings.Join(add, " "), del...); err != nil {
+		return err
+	}
+	if err := runCommand(add[0], add[1:]...); err != nil {
+		return err
+	}
+	r.addedRoutes = append(r.addedRoutes, del)
+	return nil
+}
+
+// removeAddedRoutes undoes the installed routes in reverse order. Routes that
+// could not be removed are kept for the next attempt and reported.
+func (r *RouteManager) removeAddedRoutes() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var failed [][]string
+	var errs []string
+	for i := len(r.addedRoutes) - 1; i >= 0; i-- {
+		del := r.addedRoutes[i]
+		if err := exec.Command(del[0], del[1:]...).Run(); err != nil {
+			logrus.Warnf("Failed to remove route (%s): %v", strings.Join(del, " "), err)
+			failed = append([][]string{del}, failed...)
+			errs = append(errs, fmt.Sprintf("%s: %v", strings.Join(del, " "), err))
+		}
+	}
+	r.addedRoutes = failed
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to remove %d routes: %s", len(errs), strings.Join(errs, "; "))
+	}
+	return nil
 }
 
 func (r *RouteManager) SetupClientRoutes() error {
@@ -31,7 +137,6 @@ func (r *RouteManager) SetupClientRoutes() error {
 		return fmt.Errorf("get default gateway: %v", err)
 	}
 	r.originalGW = gw
-	r.originalDNS = r.getCurrentDNS()
 	switch runtime.GOOS {
 	case "linux":
 		return r.SetupLinuxRoutes()
@@ -45,73 +150,193 @@ func (r *RouteManager) SetupClientRoutes() error {
 }
 
 func (r *RouteManager) SetupLinuxRoutes() error {
-	serverHost, _, _ := net.SplitHostPort(r.serverIP)
-	cmd := exec.Command("ip", "route", "add", serverHost, "via", r.originalGW)
-	if err := cmd.Run(); err != nil {
-		logrus.Warnf("Failed to setup routes: %v", err)
+	if r.table == 0 || r.mark == 0 {
+		return fmt.Errorf("policy routing needs a route table and fwmark")
+	}
+	table := fmt.Sprintf("%d", r.table)
+	mark := fmt.Sprintf("%d", r.mark)
+	// drop leftovers from a previous run that did not shut down cleanly
+	_ = exec.Command("ip", "route", "flush", "table", table).Run()
+	_ = exec.Command("ip", "-6", "route", "flush", "table", table).Run()
+	for _, family := range []string{"-4", "-6"} {
+		for exec.Command("ip", family, "rule", "del", "not", "fwmark", mark, "table", table).Run() == nil {
+		}
 	}
-	cmd = exec.Command("ip", "route", "del", "default")
-	_ = cmd.Run()
-	cmd = exec.Command("ip", "route", "add", "0.0.0.0/1", "dev", r.tunName)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to add route 0.0.0.0/1: %v", err)
+	ipv6 := false
+	for _, cidr := range r.tunnelRoutes() {
+		ipv6 = ipv6 || isIPv6CIDR(cidr)
+		if err := r.addRoute([]string{"ip", "route", "add", cidr, "dev", r.tunName, "table", table},
+			[]string{"ip", "route", "del", cidr, "dev", r.tunName, "table", table}); err != nil {
+			return fmt.Errorf("failed to add route %s: %v", cidr, err)
+		}
 	}
-	cmd = exec.Command("ip", "route", "add", "128.0.0.0/1", "dev", r.tunName)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to add route 128.0.0.0/1: %v", err)
+	for _, cidr := range r.excludeRoutes {
+		ipv6 = ipv6 || isIPv6CIDR(cidr)
+		if err := r.addRoute([]string{"ip", "route", "add", "throw", cidr, "table", table},
+			[]string{"ip", "route", "del", "throw", cidr, "table", table}); err != nil {
+			return fmt.Errorf("failed to add excluded route %s: %v", cidr, err)
+		}
 	}
-	if err := r.setupDNS(); err != nil {
-		logrus.Warnf("Failed to setup DNS: %v", err)
+	if r.blockIPv6 && !r.ipv6 && ipv6Enabled() {
+		for _, cidr := range []string{"::/1", "8000::/1"} {
+			if err := r.addRoute([]string{"ip", "-6", "route", "add", "unreachable", cidr, "table", table},
+				[]string{"ip", "-6", "route", "del", "unreachable", cidr, "table", table}); err != nil {
+				return fmt.Errorf("failed to block IPv6: %v", err)
+			}
+		}
+		ipv6 = true
+		logrus.Info("IPv6 is blocked while connected")
+	}
+	families := []string{"-4"}
+	if ipv6 || r.ipv6 {
+		families = append(families, "-6")
+	}
+	for _, family := range families {
+		// the client's own socket carries the mark, so the server connection
+		// keeps using the main table
+		if err := r.addRoute([]string{"ip", family, "rule", "add", "not", "fwmark", mark, "table", table},
+			[]string{"ip", family, "rule", "del", "not", "fwmark", mark, "table", table}); err != nil {
+			return fmt.Errorf("failed to add routing rule: %v", err)
+		}
+		// more specific routes of the main table (LAN, docker, link-local
+		// IPv6, ...) still win
+		if err := r.addRoute([]string{"ip", family, "rule", "add", "table", "main", "suppress_prefixlength", "0"},
+			[]string{"ip", family, "rule", "del", "table", "main", "suppress_prefixlength", "0"}); err != nil {
+			return fmt.Errorf("failed to add routing rule: %v", err)
+		}
+	}
+	if err := r.enableSrcValidMark(); err != nil {
+		logrus.Warnf("Failed to enable src_valid_mark: %v", err)
 	}
 	return nil
 }
 
-func (r *RouteManager) setupDNS() error {
-	if len(r.vpnDNS) == 0 {
+func isIPv6CIDR(cidr string) bool {
+	return strings.Contains(cidr, ":")
+}
+
+func ipv6Enabled() bool {
+	_, err := os.Stat("/proc/net/if_inet6")
+	return err == nil
+}
+
+func (r *RouteManager) enableSrcValidMark() error {
+	const key = "net.ipv4.conf.all.src_valid_mark"
+	output, err := exec.Command("sysctl", "-n", key).Output()
+	if err != nil {
+		return err
+	}
+	previous := strings.TrimSpace(string(output))
+	if previous == "1" {
 		return nil
 	}
+	// reverted with the routes on disconnect
+	return r.addRoute([]string{"sysctl", "-q", "-w", key + "=1"}, []string{"sysctl", "-q", "-w", key + "=" + previous})
+}
+
+func (r *RouteManager) AddHostRoute(ip string) error {
 	switch runtime.GOOS {
 	case "linux":
-		_ = exec.Command("cp", "/etc/resolv.conf", "/etc/resolv.conf.vpnbackup").Run()
-		content := ""
-		for _, dns := range r.vpnDNS {
-			content += fmt.Sprintf("nameserver %s\n", dns)
+		if err := r.journal.Record("route "+ip+" through the tunnel", r.hostRouteUndo(ip)...); err != nil {
+			return err
 		}
-		cmd := exec.Command("sh", "-c", fmt.Sprintf("echo '%s' > /etc/resolv.conf", content))
-		return cmd.Run()
+		return runCommand("ip", "route", "replace", hostPrefix(ip), "dev", r.tunName, "table", fmt.Sprintf("%d", r.table))
 	case "darwin":
-		services, _ := exec.Command("networksetup", "-listallnetworkservices").Output()
-		serviceList := strings.Split(string(services), "\n")
-		for _, service := range serviceList {
-			service = strings.TrimSpace(service)
-			if service != "" && !strings.Contains(service, "*") {
-				args := []string{"-setdnsservers", service}
-				args = append(args, r.vpnDNS...)
-				exec.Command("networksetup", args...).Run()
-			}
+		if err := r.journal.Record("route "+ip+" through the tunnel", r.hostRouteUndo(ip)...); err != nil {
+			return err
 		}
+		return runCommand("route", "add", darwinFamily(hostPrefix(ip)), "-host", ip, "-interface", r.tunName)
+	default:
+		return fmt.Errorf("unsupported platform %s", runtime.GOOS)
+	}
+}
+
+// DeleteHostRoute removes the route and its journal entry, so the journal of
+// a long running client does not grow with every DNS answer.
+func (r *RouteManager) DeleteHostRoute(ip string) error {
+	undo := r.hostRouteUndo(ip)
+	if undo == nil {
+		return nil
+	}
+	if err := runCommand(undo[0], undo[1:]...); err != nil {
+		return err
+	}
+	return r.journal.Forget(undo...)
+}
+
+func (r *RouteManager) hostRouteUndo(ip string) []string {
+	prefix := hostPrefix(ip)
+	switch runtime.GOOS {
+	case "linux":
+		return []string{"ip", "route", "del", prefix, "dev", r.tunName, "table", fmt.Sprintf("%d", r.table)}
+	case "darwin":
+		return []string{"route", "delete", darwinFamily(prefix), "-host", ip}
+	default:
+		return nil
+	}
+}
+
+func hostPrefix(ip string) string {
+	if isIPv6CIDR(ip) {
+		return ip + "/128"
+	}
+	return ip + "/32"
+}
+
+func runCommand(name string, args ...string) error {
+	if output, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(output)))
 	}
 	return nil
 }
 
 func (r *RouteManager) SetupWindowsRoutes() error {
-	serverHost, _, _ := net.SplitHostPort(r.serverIP)
-	cmd := exec.Command("route", "add", serverHost, "mask", "255.255.255.255", r.originalGW)
-	if err := cmd.Run(); err != nil {
-		logrus.Warnf("Failed to add server route: %v", err)
+	for _, serverHost := range r.endpointHosts() {
+		if err := r.addRoute([]string{"route", "add", serverHost, "mask", "255.255.255.255", r.originalGW},
+			[]string{"route", "delete", serverHost, "mask", "255.255.255.255"}); err != nil {
+			logrus.Warnf("Failed to add server route: %v", err)
+		}
 	}
 	tunIP := r.getTUNIP()
-	cmd = exec.Command("route", "add", "0.0.0.0", "mask", "128.0.0.0", tunIP)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to add route 0.0.0.0/1: %v", err)
+	for _, cidr := range r.tunnelRoutes() {
+		if isIPv6CIDR(cidr) {
+			if err := r.addRoute([]string{"netsh", "interface", "ipv6", "add", "route", cidr, "interface=" + r.tunName},
+				[]string{"netsh", "interface", "ipv6", "delete", "route", cidr, "interface=" + r.tunName}); err != nil {
+				return fmt.Errorf("failed to add route %s: %v", cidr, err)
+			}
+			continue
+		}
+		ip, mask := cidrToMask(cidr)
+		if err := r.addRoute([]string{"route", "add", ip, "mask", mask, tunIP},
+			[]string{"route", "delete", ip, "mask", mask, tunIP}); err != nil {
+			return fmt.Errorf("failed to add route %s: %v", cidr, err)
+		}
+	}
+	for _, cidr := range r.excludeRoutes {
+		if isIPv6CIDR(cidr) {
+			logrus.Warnf("Excluding IPv6 route %s is not supported on Windows", cidr)
+			continue
+		}
+		ip, mask := cidrToMask(cidr)
+		if err := r.addRoute([]string{"route", "add", ip, "mask", mask, r.originalGW},
+			[]string{"route", "delete", ip, "mask", mask, r.originalGW}); err != nil {
+			return fmt.Errorf("failed to add excluded route %s: %v", cidr, err)
+		}
 	}
-	cmd = exec.Command("route", "add", "128.0.0.0", "mask", "128.0.0.0", tunIP)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to add route 128.0.0.0/1: %v", err)
+	if r.blockIPv6 && !r.ipv6 {
+		logrus.Warn("IPv6 blocking is not supported on Windows, IPv6 traffic bypasses the tunnel")
 	}
 	return nil
 }
 
+func cidrToMask(cidr string) (string, string) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return cidr, "255.255.255.255"
+	}
+	return network.IP.String(), net.IP(network.Mask).String()
+}
+
 func (r *RouteManager) getTUNIP() string {
 	iface, err := net.InterfaceByName(r.tunName)
 	if err != nil {
@@ -130,26 +355,48 @@ func (r *RouteManager) getTUNIP() string {
 }
 
 func (r *RouteManager) SetupDarwinRoutes() error {
-	serverHost, _, _ := net.SplitHostPort(r.serverIP)
-	cmd := exec.Command("route", "add", "-host", serverHost, r.originalGW)
-	if err := cmd.Run(); err != nil {
-		logrus.Warnf("Failed to add server route: %v", err)
+	for _, serverHost := range r.endpointHosts() {
+		if err := r.addRoute([]string{"route", "add", "-host", serverHost, r.originalGW},
+			[]string{"route", "delete", "-host", serverHost}); err != nil {
+			logrus.Warnf("Failed to add server route: %v", err)
+		}
 	}
-	cmd = exec.Command("route", "add", "-net", "0.0.0.0/1", "-interface", r.tunName)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to add route 0.0.0.0/1: %v", err)
+	for _, cidr := range r.tunnelRoutes() {
+		family := darwinFamily(cidr)
+		if err := r.addRoute([]string{"route", "add", family, "-net", cidr, "-interface", r.tunName},
+			[]string{"route", "delete", family, "-net", cidr, "-interface", r.tunName}); err != nil {
+			return fmt.Errorf("failed to add route %s: %v", cidr, err)
+		}
 	}
-	cmd = exec.Command("route", "add", "-net", "128.0.0.0/1", "-interface", r.tunName)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to add route 128.0.0.0/1: %v", err)
+	for _, cidr := range r.excludeRoutes {
+		if isIPv6CIDR(cidr) {
+			// originalGW is the IPv4 gateway
+			logrus.Warnf("Excluding IPv6 route %s is not supported on macOS", cidr)
+			continue
+		}
+		if err := r.addRoute([]string{"route", "add", "-net", cidr, r.originalGW},
+			[]string{"route", "delete", "-net", cidr, r.originalGW}); err != nil {
+			return fmt.Errorf("failed to add excluded route %s: %v", cidr, err)
+		}
 	}
-	if err := r.setupDNS(); err != nil {
-		logrus.Warnf("Failed to setup DNS: %v", err)
+	if r.blockIPv6 && !r.ipv6 {
+		for _, cidr := range []string{"::/1", "8000::/1"} {
+			if err := r.addRoute([]string{"route", "add", "-inet6", "-net", cidr, "::1", "-blackhole"},
+				[]string{"route", "delete", "-inet6", "-net", cidr}); err != nil {
+				return fmt.Errorf("failed to block IPv6: %v", err)
+			}
+		}
 	}
-
 	return nil
 }
 
+func darwinFamily(cidr string) string {
+	if isIPv6CIDR(cidr) {
+		return "-inet6"
+	}
+	return "-inet"
+}
+
 func (r *RouteManager) getDefaultGateway() (string, error) {
 	switch runtime.GOOS {
 	case "linux":
@@ -198,39 +445,6 @@ func (r *RouteManager) getDefaultGateway() (string, error) {
 	return "", fmt.Errorf("failed to find default gateway")
 }
 
-func (r *RouteManager) getCurrentDNS() []string {
-	var dns []string
-	switch runtime.GOOS {
-	case "linux":
-		data, err := exec.Command("cat", "/etc/resolv.conf").Output()
-		if err != nil {
-			lines := strings.Split(string(data), "\n")
-			for _, line := range lines {
-				if strings.Contains(line, "nameserver") {
-					fields := strings.Fields(line)
-					if len(fields) >= 2 {
-						dns = append(dns, fields[1])
-					}
-				}
-			}
-		}
-	case "darwin":
-		out, err := exec.Command("scutil", "--dns").Output()
-		if err != nil {
-			lines := strings.Split(string(out), "\n")
-			for _, line := range lines {
-				if strings.Contains(line, "nameserver") {
-					fields := strings.Fields(line)
-					if len(fields) >= 3 {
-						dns = append(dns, fields[2])
-					}
-				}
-			}
-		}
-	}
-	return dns
-}
-
 func (r *RouteManager) RestoreRoutes() error {
 	switch runtime.GOOS {
 	case "linux":
@@ -245,47 +459,12 @@ func (r *RouteManager) RestoreRoutes() error {
 }
 
 func (r *RouteManager) restoreLinuxRoutes() error {
-	exec.Command("ip", "route", "del", "0.0.0.0/1").Run()
-	exec.Command("ip", "route", "del", "128.0.0.0/1").Run()
-	serverHost, _, _ := net.SplitHostPort(r.serverIP)
-	exec.Command("ip", "route", "del", serverHost).Run()
-	if r.originalGW != "" {
-		cmd := exec.Command("ip", "route", "add", "default", "via", r.originalGW)
-		cmd.Run()
-	}
-	r.restoreDNS()
-
-	return nil
+	return r.removeAddedRoutes()
 }
 
 func (r *RouteManager) restoreDarwinRoutes() error {
-	exec.Command("route", "delete", "-net", "0.0.0.0/1").Run()
-	exec.Command("route", "delete", "-net", "128.0.0.0/1").Run()
-	serverHost, _, _ := net.SplitHostPort(r.serverIP)
-	exec.Command("route", "delete", "-host", serverHost).Run()
-	r.restoreDNS()
-	return nil
+	return r.removeAddedRoutes()
 }
 func (r *RouteManager) restoreWindowsRoutes() error {
-	exec.Command("route", "delete", "0.0.0.0").Run()
-	exec.Command("route", "delete", "128.0.0.0").Run()
-	serverHost, _, _ := net.SplitHostPort(r.serverIP)
-	exec.Command("route", "delete", serverHost).Run()
-	return nil
-}
-
-func (r *RouteManager) restoreDNS() {
-	switch runtime.GOOS {
-	case "linux":
-		exec.Command("mv", "/etc/resolv.conf.vpnbackup", "/etc/resolv.conf").Run()
-	case "darwin":
-		services, _ := exec.Command("networksetup", "-listallnetworkservices").Output()
-		serviceList := strings.Split(string(services), "\n")
-		for _, service := range serviceList {
-			service = strings.TrimSpace(service)
-			if service != "" && !strings.Contains(service, "*") {
-				_ = exec.Command("networksetup", "-setdnsservers", service, "Empty").Run()
-			}
-		}
-	}
+	return r.removeAddedRoutes()
 }
@@ -14,6 +14,9 @@ type TUNInterface struct {
 	name     string
 	ip       string
 	subnet   string
+	ip6      string
+	subnet6  string
+	nat6     string
 	mtu      int
 	isServer bool
 }
@@ -56,7 +59,7 @@ func (tun *TUNInterface) Configure() error {
 }
 
 func (tun *TUNInterface) configureLinux() error {
-	cmd := exec.Command("ip", "addr", "add", tun.ip+"/24", "dev", tun.name)
+	cmd := exec.Command("ip", "addr", "add", fmt.Sprintf("%s/%d", tun.ip, prefixLength(tun.subnet, 24)), "dev", tun.name)
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to set up IP address: %v", err)
 	}
@@ -74,7 +77,7 @@ func (tun *TUNInterface) configureLinux() error {
 		if err := cmd.Run(); err != nil {
 			logrus.Warnf("failed to set ip forward: %v", err)
 		}
-		cmd = exec.Command("iptables", "-t", "nat", "POSTROUTING",
+		cmd = exec.Command("iptables", "-t", "nat", "-A", "POSTROUTING",
 			"-s", tun.subnet, "-o", getDefaultInterface(), "-j", "MASQUERADE")
 		if err := cmd.Run(); err != nil {
 			logrus.Warnf("failed to set up iptables: %v", err)
@@ -104,14 +107,87 @@ func (tun *TUNInterface) configureDarwin() error {
 	return nil
 }
 func (tun *TUNInterface) configureWindows() error {
+	_, mask := cidrToMask(tun.subnet)
 	cmd := exec.Command("netsh", "interface", "ip", "set", "address",
-		fmt.Sprintf("name=%s", tun.name), "static", tun.ip, "255.255.255.0")
+		fmt.Sprintf("name=%s", tun.name), "static", tun.ip, mask)
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to bring up interface: %v", err)
 	}
 	return nil
 }
 
+// ConfigureIPv6 adds ip from subnet to the interface. On the server it also
+// enables IPv6 forwarding and either masquerades the subnet (nat
+// "masquerade"), maps it 1:1 onto the public prefix given in nat (NPTv6) or
+// routes it as is ("none").
+func (tun *TUNInterface) ConfigureIPv6(ip, subnet, nat string) error {
+	address := fmt.Sprintf("%s/%d", ip, prefixLength(subnet, 64))
+	var err error
+	switch runtime.GOOS {
+	case "linux":
+		err = runCommand("ip", "-6", "addr", "add", address, "dev", tun.name)
+	case "darwin":
+		err = runCommand("ifconfig", tun.name, "inet6", ip, "prefixlen", fmt.Sprintf("%d", prefixLength(subnet, 64)))
+	case "windows":
+		err = runCommand("netsh", "interface", "ipv6", "add", "address", "interface="+tun.name, "address="+address)
+	default:
+		return fmt.Errorf("unsupported platform")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set up IPv6 address: %v", err)
+	}
+	tun.ip6 = ip
+	tun.subnet6 = subnet
+	if !tun.isServer {
+		return nil
+	}
+	switch runtime.GOOS {
+	case "linux":
+		if err := runCommand("sysctl", "-w", "net.ipv6.conf.all.forwarding=1"); err != nil {
+			logrus.Warnf("failed to set ipv6 forward: %v", err)
+		}
+		tun.nat6 = nat
+		for _, rule := range tun.nat6Rules() {
+			if err := runCommand("ip6tables", append([]string{"-t", rule[0], "-A", rule[1]}, rule[2:]...)...); err != nil {
+				return fmt.Errorf("failed to set up IPv6 NAT: %v", err)
+			}
+		}
+	case "darwin":
+		if err := runCommand("sysctl", "-w", "net.inet6.ip6.forwarding=1"); err != nil {
+			logrus.Warnf("failed to set ipv6 forward: %v", err)
+		}
+	}
+	return nil
+}
+
+// nat6Rules returns the ip6tables rules for the configured NAT mode as table,
+// chain and rule arguments.
+func (tun *TUNInterface) nat6Rules() [][]string {
+	iface := getDefaultInterface()
+	switch tun.nat6 {
+	case "", "none":
+		return nil
+	case "masquerade":
+		return [][]string{
+			{"nat", "POSTROUTING", "-s", tun.subnet6, "-o", iface, "-j", "MASQUERADE"},
+		}
+	default:
+		return [][]string{
+			{"mangle", "POSTROUTING", "-s", tun.subnet6, "-o", iface, "-j", "SNPT", "--src-pfx", tun.subnet6, "--dst-pfx", tun.nat6},
+			{"mangle", "PREROUTING", "-d", tun.nat6, "-i", iface, "-j", "DNPT", "--src-pfx", tun.nat6, "--dst-pfx", tun.subnet6},
+		}
+	}
+}
+
+func prefixLength(subnet string, fallback int) int {
+	_, network, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return fallback
+	}
+	ones, _ := network.Mask.Size()
+	return ones
+}
+
 func (tun *TUNInterface) Read(buffer []byte) (int, error) {
 	return tun.iface.Read(buffer)
 }
@@ -124,10 +200,13 @@ func (tun *TUNInterface) Name() string {
 }
 
 func (tun *TUNInterface) Close() error {
-	if runtime.GOOS != "linux" && tun.isServer {
+	if runtime.GOOS == "linux" && tun.isServer {
 		cmd := exec.Command("iptables", "-t", "nat", "-D", "POSTROUTING",
 			"-s", tun.subnet, "-o", getDefaultInterface(), "-j", "MASQUERADE")
 		_ = cmd.Run()
+		for _, rule := range tun.nat6Rules() {
+			_ = exec.Command("ip6tables", append([]string{"-t", rule[0], "-D", rule[1]}, rule[2:]...)...).Run()
+		}
 	}
 	return tun.iface.Close()
 }
@@ -0,0 +1,129 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	DNSTypeA    uint16 = 1
+	DNSTypeAAAA uint16 = 28
+)
+
+type DNSAnswer struct {
+	Name string
+	Type uint16
+	IP   net.IP
+	TTL  time.Duration
+}
+
+type DNSMessage struct {
+	ID        uint16
+	Response  bool
+	Truncated bool
+	Question  string
+	QType     uint16
+	Answers   []DNSAnswer
+}
+
+func ParseDNSMessage(data []byte) (*DNSMessage, error) {
+	if len(data) < 12 {
+		return nil, errors.New("dns message too short")
+	}
+	msg := &DNSMessage{
+		ID:        binary.BigEndian.Uint16(data[0:2]),
+		Response:  data[2]&0x80 != 0,
+		Truncated: data[2]&0x02 != 0,
+	}
+	qdCount := int(binary.BigEndian.Uint16(data[4:6]))
+	anCount := int(binary.BigEndian.Uint16(data[6:8]))
+	offset := 12
+	for i := 0; i < qdCount; i++ {
+		name, next, err := readDNSName(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(data) {
+			return nil, errors.New("dns question truncated")
+		}
+		if i == 0 {
+			msg.Question = name
+			msg.QType = binary.BigEndian.Uint16(data[next : next+2])
+		}
+		offset = next + 4
+	}
+	for i := 0; i < anCount; i++ {
+		name, next, err := readDNSName(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+10 > len(data) {
+			return nil, errors.New("dns answer truncated")
+		}
+		rrType := binary.BigEndian.Uint16(data[next : next+2])
+		ttl := binary.BigEndian.Uint32(data[next+4 : next+8])
+		rdLen := int(binary.BigEndian.Uint16(data[next+8 : next+10]))
+		offset = next + 10
+		if offset+rdLen > len(data) {
+			return nil, errors.New("dns answer data truncated")
+		}
+		rdata := data[offset : offset+rdLen]
+		offset += rdLen
+		if (rrType == DNSTypeA && rdLen == net.IPv4len) || (rrType == DNSTypeAAAA && rdLen == net.IPv6len) {
+			msg.Answers = append(msg.Answers, DNSAnswer{
+				Name: name,
+				Type: rrType,
+				IP:   net.IP(append([]byte{}, rdata...)),
+				TTL:  time.Duration(ttl) * time.Second,
+			})
+		}
+	}
+	return msg, nil
+}
+
+func readDNSName(data []byte, offset int) (string, int, error) {
+	var labels []string
+	end := -1
+	for hops := 0; hops < 128; hops++ {
+		if offset >= len(data) {
+			return "", 0, errors.New("dns name out of range")
+		}
+		length := int(data[offset])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")), end, nil
+		case length&0xC0 == 0xC0:
+			if offset+1 >= len(data) {
+				return "", 0, errors.New("dns name pointer truncated")
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(data[offset:offset+2]) & 0x3FFF)
+		default:
+			if offset+1+length > len(data) {
+				return "", 0, errors.New("dns label truncated")
+			}
+			labels = append(labels, string(data[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+	return "", 0, errors.New("dns name has too many labels")
+}
+
+// MatchDomain reports whether name matches rule. "*.example.com" matches any
+// subdomain of example.com, any other rule matches only the exact name.
+func MatchDomain(rule, name string) bool {
+	rule = strings.ToLower(strings.TrimSuffix(rule, "."))
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if strings.HasPrefix(rule, "*.") {
+		return strings.HasSuffix(name, rule[1:])
+	}
+	return name == rule
+}
@@ -0,0 +1,110 @@
+package protocol
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func dnsHeader(flags byte, qd, an byte) []byte {
+	return []byte{0x12, 0x34, flags, 0, 0, qd, 0, an, 0, 0, 0, 0}
+}
+
+func dnsName(name string) []byte {
+	var data []byte
+	for _, label := range strings.Split(name, ".") {
+		data = append(data, byte(len(label)))
+		data = append(data, label...)
+	}
+	return append(data, 0)
+}
+
+// dnsRecord is an answer whose name points to the question at offset 12.
+func dnsRecord(rrType byte, ttl byte, rdata ...byte) []byte {
+	record := []byte{0xC0, 12, 0, rrType, 0, 1, 0, 0, 0, ttl, 0, byte(len(rdata))}
+	return append(record, rdata...)
+}
+
+func join(parts ...[]byte) []byte {
+	var data []byte
+	for _, part := range parts {
+		data = append(data, part...)
+	}
+	return data
+}
+
+func TestParseDNSMessage(t *testing.T) {
+	question := join(dnsName("www.Example.com"), []byte{0, 1, 0, 1})
+	ip6 := net.ParseIP("2001:db8::1")
+	tests := []struct {
+		name string
+		data []byte
+		want *DNSMessage
+	}{
+		{
+			"query",
+			join(dnsHeader(0x01, 1, 0), question),
+			&DNSMessage{ID: 0x1234, Question: "www.example.com", QType: DNSTypeA},
+		},
+		{
+			"answers",
+			join(dnsHeader(0x81, 1, 3), question,
+				dnsRecord(5, 60, dnsName("cdn.example.net")...),
+				dnsRecord(1, 60, 192, 0, 2, 1),
+				dnsRecord(28, 120, ip6...)),
+			&DNSMessage{ID: 0x1234, Response: true, Question: "www.example.com", QType: DNSTypeA, Answers: []DNSAnswer{
+				{Name: "www.example.com", Type: DNSTypeA, IP: net.IP{192, 0, 2, 1}, TTL: time.Minute},
+				{Name: "www.example.com", Type: DNSTypeAAAA, IP: ip6, TTL: 2 * time.Minute},
+			}},
+		},
+		{
+			"truncated flag",
+			join(dnsHeader(0x83, 1, 0), question),
+			&DNSMessage{ID: 0x1234, Response: true, Truncated: true, Question: "www.example.com", QType: DNSTypeA},
+		},
+		{"short header", dnsHeader(0x81, 0, 0)[:11], nil},
+		{"truncated question", join(dnsHeader(0x01, 1, 0), dnsName("example.com"), []byte{0, 1}), nil},
+		{"truncated label", join(dnsHeader(0x01, 1, 0), []byte{7, 'e', 'x'}), nil},
+		{"truncated answer", join(dnsHeader(0x81, 1, 1), question, dnsRecord(1, 60, 192, 0, 2, 1)[:8]), nil},
+		{"truncated answer data", join(dnsHeader(0x81, 1, 1), question, dnsRecord(1, 60, 192, 0, 2, 1)[:14]), nil},
+		{"pointer loop", join(dnsHeader(0x81, 0, 1), []byte{0xC0, 12}), nil},
+	}
+	for _, test := range tests {
+		got, err := ParseDNSMessage(test.data)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: parsed %+v, want an error", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: parsed %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMatchDomain(t *testing.T) {
+	tests := []struct {
+		rule, name string
+		want       bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "EXAMPLE.com.", true},
+		{"example.com", "www.example.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "badexample.com", false},
+	}
+	for _, test := range tests {
+		if got := MatchDomain(test.rule, test.name); got != test.want {
+			t.Errorf("MatchDomain(%q, %q) = %v, want %v", test.rule, test.name, got, test.want)
+		}
+	}
+}
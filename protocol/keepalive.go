@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	keepAlivePing   = 0
+	keepAlivePong   = 1
+	keepAliveSize   = 13
+	paramsSize      = 8
+	rttSmoothing    = 8
+	jitterSmoothing = 4
+)
+
+// KeepAliveParams are proposed by the client in the handshake and confirmed,
+// possibly adjusted, by the server.
+type KeepAliveParams struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+func (p KeepAliveParams) Marshal() []byte {
+	data := make([]byte, paramsSize)
+	binary.BigEndian.PutUint32(data[0:4], uint32(p.Interval/time.Millisecond))
+	binary.BigEndian.PutUint32(data[4:8], uint32(p.Timeout/time.Millisecond))
+	return data
+}
+
+func ParseKeepAliveParams(data []byte) (KeepAliveParams, error) {
+	if len(data) < paramsSize {
+		return KeepAliveParams{}, errors.New("invalid keepalive params")
+	}
+	return KeepAliveParams{
+		Interval: time.Duration(binary.BigEndian.Uint32(data[0:4])) * time.Millisecond,
+		Timeout:  time.Duration(binary.BigEndian.Uint32(data[4:8])) * time.Millisecond,
+	}, nil
+}
+
+// MaxMissed is how many unanswered keepalives mean the peer is gone.
+func (p KeepAliveParams) MaxMissed() int {
+	if p.Interval <= 0 || p.Timeout < 2*p.Interval {
+		return 2
+	}
+	return int(p.Timeout / p.Interval)
+}
+
+// KeepAliveTracker numbers outgoing keepalives, answers the peer's and
+// measures the round trip from the echoed timestamps. A keepalive without
+// payload comes from a peer that predates numbered keepalives.
+type KeepAliveTracker struct {
+	mu      sync.Mutex
+	seq     uint32
+	acked   uint32
+	samples int
+	rtt     time.Duration
+	srtt    time.Duration
+	rttvar  time.Duration
+}
+
+func NewKeepAliveTracker() *KeepAliveTracker {
+	return &KeepAliveTracker{}
+}
+
+func (t *KeepAliveTracker) Ping() *Message {
+	t.mu.Lock()
+	t.seq++
+	seq := t.seq
+	t.mu.Unlock()
+	return NewMessage(TypeKeepAlive, marshalKeepAlive(keepAlivePing, seq, time.Now()))
+}
+
+// Missed returns the number of keepalives sent since the last reply.
+func (t *KeepAliveTracker) Missed() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return int(t.seq - t.acked)
+}
+
+// Alive marks every keepalive sent so far as answered.
+func (t *KeepAliveTracker) Alive() {
+	t.mu.Lock()
+	t.acked = t.seq
+	t.mu.Unlock()
+}
+
+// Handle processes a numbered keepalive. For a ping it returns the reply to
+// send back; for a reply it returns the measured round trip time.
+func (t *KeepAliveTracker) Handle(data []byte) (*Message, time.Duration, error) {
+	if len(data) < keepAliveSize {
+		return nil, 0, errors.New("invalid keepalive")
+	}
+	seq := binary.BigEndian.Uint32(data[1:5])
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(data[5:13])))
+	if data[0] == keepAlivePing {
+		return NewMessage(TypeKeepAlive, marshalKeepAlive(keepAlivePong, seq, sent)), 0, nil
+	}
+	rtt := time.Since(sent)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if seq > t.acked && seq <= t.seq {
+		t.acked = seq
+	}
+	// smoothed RTT and variation as in RFC 6298
+	if t.samples == 0 {
+		t.srtt = rtt
+		t.rttvar = rtt / 2
+	} else {
+		diff := t.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		t.rttvar += (diff - t.rttvar) / jitterSmoothing
+		t.srtt += (rtt - t.srtt) / rttSmoothing
+	}
+	t.samples++
+	t.rtt = rtt
+	return nil, rtt, nil
+}
+
+// RTT returns the smoothed round trip time and its variation (jitter).
+func (t *KeepAliveTracker) RTT() (time.Duration, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.srtt, t.rttvar
+}
+
+func marshalKeepAlive(kind byte, seq uint32, sent time.Time) []byte {
+	data := make([]byte, keepAliveSize)
+	data[0] = kind
+	binary.BigEndian.PutUint32(data[1:5], seq)
+	binary.BigEndian.PutUint64(data[5:13], uint64(sent.UnixNano()))
+	return data
+}
@@ -0,0 +1,122 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"time"
+)
+
+type ObfsParams struct {
+	MaxPadding    int
+	Bucket        int
+	Jitter        time.Duration
+	CoverInterval time.Duration
+}
+
+type Obfuscator struct {
+	params ObfsParams
+}
+
+func NewObfuscator(params ObfsParams) *Obfuscator {
+	if params.Bucket <= 0 {
+		params.Bucket = 1
+	}
+	return &Obfuscator{params: params}
+}
+
+func (p ObfsParams) Marshal() []byte {
+	data := make([]byte, 10)
+	binary.BigEndian.PutUint16(data[0:2], uint16(p.MaxPadding))
+	binary.BigEndian.PutUint16(data[2:4], uint16(p.Bucket))
+	binary.BigEndian.PutUint16(data[4:6], uint16(p.Jitter/time.Millisecond))
+	binary.BigEndian.PutUint32(data[6:10], uint32(p.CoverInterval/time.Millisecond))
+	return data
+}
+
+func ParseObfsParams(data []byte) (ObfsParams, error) {
+	if len(data) < 10 {
+		return ObfsParams{}, errors.New("invalid obfuscation params")
+	}
+	return ObfsParams{
+		MaxPadding:    int(binary.BigEndian.Uint16(data[0:2])),
+		Bucket:        int(binary.BigEndian.Uint16(data[2:4])),
+		Jitter:        time.Duration(binary.BigEndian.Uint16(data[4:6])) * time.Millisecond,
+		CoverInterval: time.Duration(binary.BigEndian.Uint32(data[6:10])) * time.Millisecond,
+	}, nil
+}
+
+// WriteMessage writes msg padded. It never delays the frame: the jitter only
+// shifts when cover frames are sent, so it costs no throughput.
+func (o *Obfuscator) WriteMessage(w io.Writer, msg *Message) error {
+	if o == nil {
+		return WriteMessage(w, msg)
+	}
+	return WriteMessage(w, o.pad(msg))
+}
+
+func (o *Obfuscator) ReadMessage(r io.Reader) (*Message, error) {
+	for {
+		msg, err := ReadMessage(r)
+		if err != nil {
+			return nil, err
+		}
+		switch msg.Header.Type {
+		case TypePadding:
+			continue
+		case TypePadded:
+			return unpad(msg.Data)
+		default:
+			return msg, nil
+		}
+	}
+}
+
+func (o *Obfuscator) pad(msg *Message) *Message {
+	size := HeaderSize + len(msg.Data)
+	if o.params.MaxPadding > 0 {
+		size += rand.Intn(o.params.MaxPadding + 1)
+	}
+	size = (size + o.params.Bucket - 1) / o.params.Bucket * o.params.Bucket
+	data := make([]byte, size)
+	data[0] = msg.Header.Type
+	binary.BigEndian.PutUint32(data[1:HeaderSize], uint32(len(msg.Data)))
+	copy(data[HeaderSize:], msg.Data)
+	return NewMessage(TypePadded, data)
+}
+
+func unpad(data []byte) (*Message, error) {
+	if len(data) < HeaderSize {
+		return nil, errors.New("padded frame too short")
+	}
+	length := binary.BigEndian.Uint32(data[1:HeaderSize])
+	if int(length) > len(data)-HeaderSize {
+		return nil, errors.New("invalid padded frame length")
+	}
+	return NewMessage(data[0], data[HeaderSize:HeaderSize+int(length)]), nil
+}
+
+func (o *Obfuscator) RunCover(stop <-chan struct{}, send func(*Message) error) {
+	if o == nil || o.params.CoverInterval <= 0 {
+		return
+	}
+	for {
+		delay := o.params.CoverInterval/2 + time.Duration(rand.Int63n(int64(o.params.CoverInterval)))
+		if o.params.Jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(o.params.Jitter)))
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+			size := o.params.Bucket
+			if o.params.MaxPadding > 0 {
+				size += rand.Intn(o.params.MaxPadding + 1)
+			}
+			if err := send(NewMessage(TypePadding, make([]byte, size))); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestJitterDoesNotDelayData(t *testing.T) {
+	obfs := NewObfuscator(ObfsParams{MaxPadding: 64, Bucket: 32, Jitter: 100 * time.Millisecond})
+	var buf bytes.Buffer
+	start := time.Now()
+	for i := 0; i < 200; i++ {
+		if err := obfs.WriteMessage(&buf, NewMessage(TypeData, make([]byte, 1200))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("200 frames took %v", elapsed)
+	}
+}
+
+func TestPadUnpad(t *testing.T) {
+	tests := []struct {
+		params ObfsParams
+		size   int
+	}{
+		{ObfsParams{}, 0},
+		{ObfsParams{}, 1400},
+		{ObfsParams{Bucket: 128}, 1},
+		{ObfsParams{Bucket: 128}, 128},
+		{ObfsParams{MaxPadding: 256}, 100},
+		{ObfsParams{MaxPadding: 256, Bucket: 128}, 1400},
+	}
+	for _, test := range tests {
+		obfs := NewObfuscator(test.params)
+		data := bytes.Repeat([]byte{0xAB}, test.size)
+		for i := 0; i < 20; i++ {
+			padded := obfs.pad(NewMessage(TypeData, data))
+			bucket := obfs.params.Bucket
+			min := HeaderSize + test.size
+			max := (min + test.params.MaxPadding + bucket - 1) / bucket * bucket
+			if n := len(padded.Data); n%bucket != 0 || n < min || n > max {
+				t.Errorf("%+v: padded %d bytes to %d, want a multiple of %d between %d and %d", test.params, test.size, n, bucket, min, max)
+			}
+			msg, err := unpad(padded.Data)
+			if err != nil {
+				t.Fatalf("%+v: %v", test.params, err)
+			}
+			if msg.Header.Type != TypeData || !bytes.Equal(msg.Data, data) {
+				t.Errorf("%+v: unpadded type %d with %d bytes, want the original %d bytes", test.params, msg.Header.Type, len(msg.Data), test.size)
+			}
+		}
+	}
+}
+
+func TestUnpadRejectsBadFrames(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short header", []byte{TypeData, 0, 0}},
+		{"length beyond frame", []byte{TypeData, 0, 0, 0, 4, 1, 2, 3}},
+	}
+	for _, test := range tests {
+		if msg, err := unpad(test.data); err == nil {
+			t.Errorf("%s: unpadded %+v, want an error", test.name, msg)
+		}
+	}
+}
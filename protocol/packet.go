@@ -61,8 +61,8 @@ func ParseIPv6Packet(packet *IPPacket, data []byte) (*IPPacket, error) {
 	return packet, nil
 }
 
-func isDNS(packet *IPPacket) bool {
-	if packet.Protocol != 17 {
+func IsDNS(packet *IPPacket) bool {
+	if packet.Protocol != 17 && packet.Protocol != 6 {
 		return false
 	}
 	if len(packet.Payload) >= 4 {
@@ -4,7 +4,6 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
-	"net"
 )
 
 const (
@@ -13,6 +12,8 @@ const (
 	TypeKeepAlive    uint8 = 3
 	TypeDisconnect   uint8 = 4
 	TypeData         uint8 = 10
+	TypePadding      uint8 = 11
+	TypePadded       uint8 = 12
 	TypeError        uint8 = 255
 )
 
@@ -23,15 +24,30 @@ type Header struct {
 
 const HeaderSize = 5
 
+const KeySize = 32
+
+const (
+	ExtObfuscation   uint8 = 1
+	ExtSessionTicket uint8 = 2
+	ExtIPv6          uint8 = 3
+	ExtKeepAlive     uint8 = 4
+	// ExtIPv4 in the ack carries the tunnel address the server assigned,
+	// which differs from the requested one if that is taken in a cluster
+	ExtIPv4 uint8 = 5
+)
+
+type Extensions map[uint8][]byte
+
 type Message struct {
 	Header Header
 	Data   []byte
 }
 
 type HandshakeMsg struct {
-	Version   uint8
-	ClientIP  string
-	SharedKey []byte
+	Version    uint8
+	ClientIP   string
+	SharedKey  []byte
+	Extensions Extensions
 }
 
 func NewMessage(msgType uint8, data []byte) *Message {
@@ -44,22 +60,17 @@ func NewMessage(msgType uint8, data []byte) *Message {
 	}
 }
 
-func WriteMessage(conn net.Conn, msg *Message) error {
-	if err := binary.Write(conn, binary.BigEndian, msg.Header.Type); err != nil {
-		return err
-	}
-	if err := binary.Write(conn, binary.BigEndian, msg.Header.Length); err != nil {
-		return err
-	}
-	if msg.Header.Length > 0 {
-		if _, err := conn.Write(msg.Data); err != nil {
-			return err
-		}
-	}
-	return nil
+func WriteMessage(conn io.Writer, msg *Message) error {
+	// header and data go out in a single write so they share one TLS record
+	buf := make([]byte, HeaderSize+len(msg.Data))
+	buf[0] = msg.Header.Type
+	binary.BigEndian.PutUint32(buf[1:HeaderSize], msg.Header.Length)
+	copy(buf[HeaderSize:], msg.Data)
+	_, err := conn.Write(buf)
+	return err
 }
 
-func ReadMessage(conn net.Conn) (*Message, error) {
+func ReadMessage(conn io.Reader) (*Message, error) {
 	msg := &Message{}
 	if err := binary.Read(conn, binary.BigEndian, &msg.Header.Type); err != nil {
 		return nil, err
@@ -81,12 +92,13 @@ func ReadMessage(conn net.Conn) (*Message, error) {
 	return msg, nil
 }
 
-func CreateHandshake(version uint8, clientIP string, sharedKey []byte) *Message {
+func CreateHandshake(version uint8, clientIP string, sharedKey []byte, ext Extensions) *Message {
 	data := make([]byte, 1+len(clientIP)+1+len(sharedKey))
 	data[0] = version
 	data[1] = byte(len(clientIP))
 	copy(data[2:], clientIP)
 	copy(data[2+len(clientIP):], sharedKey)
+	data = append(data, ext.Marshal()...)
 	return NewMessage(TypeHandshake, data)
 }
 
@@ -102,10 +114,57 @@ func ParseHandshake(data []byte) (*HandshakeMsg, error) {
 	}
 	clientIP := string(data[2 : 2+IPLen])
 	sharedKey := data[2+IPLen:]
+	ext := Extensions{}
+	if len(sharedKey) > KeySize {
+		var err error
+		if ext, err = ParseExtensions(sharedKey[KeySize:]); err != nil {
+			return nil, err
+		}
+		sharedKey = sharedKey[:KeySize]
+	}
 
 	return &HandshakeMsg{
-		Version:   version,
-		ClientIP:  clientIP,
-		SharedKey: sharedKey,
+		Version:    version,
+		ClientIP:   clientIP,
+		SharedKey:  sharedKey,
+		Extensions: ext,
 	}, nil
 }
+
+func CreateHandshakeAck(ext Extensions) *Message {
+	data := append([]byte("OK"), ext.Marshal()...)
+	return NewMessage(TypeHandshakeAck, data)
+}
+
+func ParseHandshakeAck(data []byte) (Extensions, error) {
+	if len(data) < 2 || string(data[:2]) != "OK" {
+		return nil, errors.New("invalid handshake ack")
+	}
+	return ParseExtensions(data[2:])
+}
+
+func (ext Extensions) Marshal() []byte {
+	var data []byte
+	for extType, value := range ext {
+		data = append(data, extType, 0, 0)
+		binary.BigEndian.PutUint16(data[len(data)-2:], uint16(len(value)))
+		data = append(data, value...)
+	}
+	return data
+}
+
+func ParseExtensions(data []byte) (Extensions, error) {
+	ext := Extensions{}
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, errors.New("invalid extension")
+		}
+		extLen := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+extLen {
+			return nil, errors.New("invalid extension length")
+		}
+		ext[data[0]] = data[3 : 3+extLen]
+		data = data[3+extLen:]
+	}
+	return ext, nil
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net"
+	"vpn/config"
+)
+
+// peerACL parses the networks a peer may reach. A nil result allows all.
+func peerACL(peer *config.Peer) []*net.IPNet {
+	if peer == nil {
+		return nil
+	}
+	var acl []*net.IPNet
+	for _, cidr := range peer.Allow {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			acl = append(acl, network)
+		}
+	}
+	return acl
+}
+
+// owns reports whether ip is one of the client's tunnel addresses, the only
+// sources its packets may carry.
+func (client *Client) owns(ip net.IP) bool {
+	if ip.Equal(net.ParseIP(client.IP)) {
+		return true
+	}
+	return client.IP6 != "" && ip.Equal(net.ParseIP(client.IP6))
+}
+
+func (client *Client) permits(ip net.IP) bool {
+	client.mu.Lock()
+	acl := client.acl
+	client.mu.Unlock()
+	if len(acl) == 0 {
+		return true
+	}
+	for _, network := range acl {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClientOwns(t *testing.T) {
+	client := &Client{IP: "10.0.0.2", IP6: "fd00::2"}
+	tests := []struct {
+		src  string
+		owns bool
+	}{
+		{"10.0.0.2", true},
+		{"fd00::2", true},
+		{"10.0.0.3", false},
+		{"fd00::3", false},
+		{"::ffff:10.0.0.3", false},
+	}
+	for _, test := range tests {
+		if got := client.owns(net.ParseIP(test.src)); got != test.owns {
+			t.Errorf("owns(%s) = %v, want %v", test.src, got, test.owns)
+		}
+	}
+	if (&Client{IP: "10.0.0.2"}).owns(net.ParseIP("fd00::2")) {
+		t.Error("client without IPv6 owns an IPv6 source")
+	}
+}
@@ -0,0 +1,390 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"vpn/config"
+	"vpn/protocol"
+)
+
+var errSessionNotFound = errors.New("session not found")
+
+// kickGrace is how long a kicked client's writer has to send the reason.
+const kickGrace = time.Second
+
+type sessionInfo struct {
+	ID          string    `json:"id"`
+	Peer        string    `json:"peer,omitempty"`
+	IP          string    `json:"ip"`
+	IP6         string    `json:"ip6,omitempty"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	LastSeen    time.Time `json:"last_seen"`
+	BytesIn     uint64    `json:"bytes_in"`
+	BytesOut    uint64    `json:"bytes_out"`
+	RTT         float64   `json:"rtt_ms,omitempty"`
+	Jitter      float64   `json:"jitter_ms,omitempty"`
+}
+
+// startAdmin serves the admin API on its own listener. Every request needs
+// "Authorization: Bearer <token>".
+func (server *Server) startAdmin() error {
+	token := server.config.AdminToken
+	if token == "" {
+		var err error
+		tokenFile := filepath.Join(server.config.DataDir, "admin.token")
+		if token, err = loadOrCreateToken(tokenFile); err != nil {
+			return fmt.Errorf("admin token: %v", err)
+		}
+		logrus.Infof("admin API token in %s", tokenFile)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/sessions", server.handleSessions)
+	mux.HandleFunc("/api/sessions/", server.handleSession)
+	mux.HandleFunc("/api/peers", server.handlePeers)
+	mux.HandleFunc("/api/peers/", server.handlePeer)
+	mux.HandleFunc("/api/reload", server.handleReload)
+	mux.HandleFunc("/api/cluster", server.handleCluster)
+	listener, err := net.Listen("tcp", server.config.AdminAddr)
+	if err != nil {
+		return fmt.Errorf("admin listener: %v", err)
+	}
+	server.admin = &http.Server{
+		Handler:           requireToken(token, mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go server.admin.Serve(listener)
+	logrus.Infof("admin API listening on %s", listener.Addr())
+	return nil
+}
+
+func (server *Server) stopAdmin() {
+	if server.admin == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.admin.Shutdown(ctx)
+}
+
+func loadOrCreateToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	return token, os.WriteFile(path, []byte(token+"\n"), 0600)
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// pathArg returns the unescaped path element after prefix and the optional
+// action after it: "/api/peers/alice/disable" gives "alice", "disable".
+func pathArg(r *http.Request, prefix string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.EscapedPath(), prefix), "/", 2)
+	arg, _ := url.PathUnescape(parts[0])
+	if len(parts) == 2 {
+		return arg, parts[1]
+	}
+	return arg, ""
+}
+
+func (server *Server) sessions() []sessionInfo {
+	server.clientsMu.RLock()
+	defer server.clientsMu.RUnlock()
+	sessions := make([]sessionInfo, 0, len(server.clients))
+	for _, client := range server.clients {
+		rtt, jitter := client.tracker.RTT()
+		client.mu.Lock()
+		sessions = append(sessions, sessionInfo{
+			ID:          client.ID,
+			Peer:        peerName(client),
+			IP:          client.IP,
+			IP6:         client.IP6,
+			RemoteAddr:  client.Conn.RemoteAddr().String(),
+			ConnectedAt: client.ConnectedAt,
+			LastSeen:    client.LastSeen,
+			BytesIn:     client.BytesIn,
+			BytesOut:    client.BytesOut,
+			RTT:         float64(rtt) / float64(time.Millisecond),
+			Jitter:      float64(jitter) / float64(time.Millisecond),
+		})
+		client.mu.Unlock()
+	}
+	return sessions
+}
+
+func (server *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	writeJSON(w, http.StatusOK, server.sessions())
+}
+
+// handleSession serves DELETE /api/sessions/{id} with an optional
+// {"reason": "..."} body that is passed on to the client.
+func (server *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	id, action := pathArg(r, "/api/sessions/")
+	if r.Method != http.MethodDelete || action != "" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	var request struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if request.Reason == "" {
+		request.Reason = "disconnected by administrator"
+	}
+	if err := server.kickClient(id, request.Reason); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) kickClient(id, reason string) error {
+	server.clientsMu.RLock()
+	client, ok := server.clients[id]
+	server.clientsMu.RUnlock()
+	if !ok {
+		return errSessionNotFound
+	}
+	logrus.Infof("Kicking client %s: %s", id, reason)
+	client.mu.Lock()
+	client.kicked = true
+	client.mu.Unlock()
+	// the writer closes the connection once the reason is sent; a client
+	// whose queue is stuck is closed regardless
+	if err := client.send(protocol.NewMessage(protocol.TypeDisconnect, []byte(reason))); err != nil {
+		return client.Conn.Close()
+	}
+	time.AfterFunc(kickGrace, func() { client.Conn.Close() })
+	return nil
+}
+
+func (server *Server) kickPeer(name, reason string) {
+	server.clientsMu.RLock()
+	var ids []string
+	for id, client := range server.clients {
+		if peerName(client) == name {
+			ids = append(ids, id)
+		}
+	}
+	server.clientsMu.RUnlock()
+	for _, id := range ids {
+		server.kickClient(id, reason)
+	}
+}
+
+func (server *Server) handlePeers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		server.peersMu.RLock()
+		peers := append([]config.Peer{}, server.config.Peers...)
+		server.peersMu.RUnlock()
+		writeJSON(w, http.StatusOK, peers)
+	case http.MethodPost:
+		var peer config.Peer
+		if err := json.NewDecoder(r.Body).Decode(&peer); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if peer.Name == "" {
+			writeError(w, http.StatusBadRequest, errors.New("peer name is required"))
+			return
+		}
+		if peer.IP != "" && net.ParseIP(peer.IP) == nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid IP %q", peer.IP))
+			return
+		}
+		for _, cidr := range peer.Allow {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid allow CIDR %q", cidr))
+				return
+			}
+		}
+		err := server.updatePeers(func(peers []config.Peer) ([]config.Peer, error) {
+			if config.FindPeer(peers, peer.Name) != nil {
+				return nil, fmt.Errorf("peer %q already exists", peer.Name)
+			}
+			if peer.IP != "" {
+				if err := config.CheckPeerIP(server.config.VPNSubnet, server.config.ServerIP, peer.IP, peers); err != nil {
+					return nil, err
+				}
+			}
+			return append(peers, peer), nil
+		})
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		logrus.Infof("Peer %s added", peer.Name)
+		writeJSON(w, http.StatusCreated, peer)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// handlePeer serves DELETE /api/peers/{name} and POST
+// /api/peers/{name}/{disable,enable}. Removing or disabling a peer also
+// disconnects its sessions.
+func (server *Server) handlePeer(w http.ResponseWriter, r *http.Request) {
+	name, action := pathArg(r, "/api/peers/")
+	if r.Method == http.MethodGet && action == "profile" {
+		server.handlePeerProfile(w, r, name)
+		return
+	}
+	var update func(peers []config.Peer) ([]config.Peer, error)
+	switch {
+	case r.Method == http.MethodDelete && action == "":
+		update = func(peers []config.Peer) ([]config.Peer, error) {
+			for i := range peers {
+				if peers[i].Name == name {
+					return append(peers[:i], peers[i+1:]...), nil
+				}
+			}
+			return nil, fmt.Errorf("peer %q not found", name)
+		}
+	case r.Method == http.MethodPost && (action == "disable" || action == "enable"):
+		update = func(peers []config.Peer) ([]config.Peer, error) {
+			peer := config.FindPeer(peers, name)
+			if peer == nil {
+				return nil, fmt.Errorf("peer %q not found", name)
+			}
+			peer.Disabled = action == "disable"
+			return peers, nil
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	if err := server.updatePeers(update); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	switch {
+	case action == "":
+		logrus.Infof("Peer %s removed", name)
+		server.kickPeer(name, "peer removed")
+		server.forgetPeer(name)
+	case action == "disable":
+		logrus.Infof("Peer %s disabled", name)
+		server.kickPeer(name, "peer disabled")
+	default:
+		logrus.Infof("Peer %s enabled", name)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePeerProfile serves GET /api/peers/{name}/profile[?endpoint=host:port...]
+// with the peer's client profile and its govpn:// import URI.
+func (server *Server) handlePeerProfile(w http.ResponseWriter, r *http.Request, name string) {
+	profile, err := server.PeerProfile(name, r.URL.Query()["endpoint"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	uri, err := profile.URI()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"uri":     uri,
+		"profile": profile,
+	})
+}
+
+// updatePeers applies update to a copy of the peer list and persists the
+// result before the server starts using it.
+func (server *Server) updatePeers(update func([]config.Peer) ([]config.Peer, error)) error {
+	server.peersMu.Lock()
+	defer server.peersMu.Unlock()
+	peers, err := update(append([]config.Peer{}, server.config.Peers...))
+	if err != nil {
+		return err
+	}
+	if err := config.SavePeers(config.PeersFile(server.config.DataDir), peers); err != nil {
+		return fmt.Errorf("save peers: %v", err)
+	}
+	if err := server.sharePeers(peers); err != nil {
+		return fmt.Errorf("share peers with the cluster: %v", err)
+	}
+	server.config.Peers = peers
+	return nil
+}
+
+func (server *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	if err := server.ReloadConfig(); err != nil {
+		logrus.Errorf("Reload failed: %v", err)
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) handleCluster(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	info, err := server.clusterInfo()
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
@@ -0,0 +1,409 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"vpn/cluster"
+	"vpn/config"
+	"vpn/protocol"
+)
+
+// clusterNode is this server's part in a cluster: it shares IP leases and
+// peers through the store and forwards packets for clients of other nodes
+// over the link.
+type clusterNode struct {
+	name  string
+	addr  string
+	store cluster.Store
+	link  *cluster.Link
+
+	mu            sync.RWMutex
+	state         *cluster.State // as of the last heartbeat, read only
+	peersRevision uint64
+}
+
+type clusterInfo struct {
+	Node    string            `json:"node"`
+	Members []*cluster.Member `json:"members"`
+	Leases  []*cluster.Lease  `json:"leases"`
+}
+
+// SetClusterStore makes the server join a cluster through store instead of
+// the file store named by the cluster-store setting.
+func (server *Server) SetClusterStore(store cluster.Store) {
+	server.clusterStore = store
+}
+
+func (server *Server) startCluster() error {
+	store := server.clusterStore
+	if store == nil {
+		if server.config.ClusterStore == "" {
+			return nil
+		}
+		var err error
+		if store, err = cluster.NewFileStore(server.config.ClusterStore); err != nil {
+			return fmt.Errorf("open cluster store: %v", err)
+		}
+	}
+	key, err := config.ParseKey(server.config.ClusterKey)
+	if err != nil {
+		return fmt.Errorf("cluster key: %v", err)
+	}
+	hostname, _ := os.Hostname()
+	name := server.config.ClusterNode
+	if name == "" {
+		name = hostname
+	}
+	addr := server.config.ClusterAddr
+	if addr == "" {
+		host, port, err := net.SplitHostPort(server.config.ClusterListen)
+		if err != nil {
+			return fmt.Errorf("invalid cluster listen address: %v", err)
+		}
+		if host == "" {
+			host = hostname
+		}
+		addr = net.JoinHostPort(host, port)
+	}
+	link, err := cluster.Listen(server.config.ClusterListen, name, key, server.deliverForwarded)
+	if err != nil {
+		return fmt.Errorf("cluster listener: %v", err)
+	}
+	server.cluster = &clusterNode{name: name, addr: addr, store: store, link: link}
+	if err := server.heartbeat(); err != nil {
+		link.Close()
+		server.cluster = nil
+		return fmt.Errorf("join cluster: %v", err)
+	}
+	logrus.Infof("cluster node %s joined, link on %s reachable as %s", name, link.Addr(), addr)
+	go server.clusterLoop()
+	return nil
+}
+
+func (server *Server) clusterLoop() {
+	ticker := time.NewTicker(cluster.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-server.stopChan:
+			return
+		case <-ticker.C:
+			if err := server.heartbeat(); err != nil {
+				logrus.Warnf("cluster heartbeat failed: %v", err)
+			}
+		}
+	}
+}
+
+// heartbeat renews this node and the leases of its live sessions, then acts
+// on what other nodes changed: sessions that resumed elsewhere are dropped
+// and a new peer list is applied.
+func (server *Server) heartbeat() error {
+	node := server.cluster
+	live := map[string]bool{}
+	server.clientsMu.RLock()
+	for _, client := range server.clients {
+		live[client.IP] = true
+	}
+	server.clientsMu.RUnlock()
+	now := time.Now()
+	var state *cluster.State
+	err := node.store.Update(func(s *cluster.State) error {
+		s.Expire(now)
+		s.Members[node.name] = &cluster.Member{Name: node.name, Addr: node.addr, Expires: now.Add(cluster.MemberTTL)}
+		for ip, lease := range s.Leases {
+			if lease.Node == node.name && live[ip] {
+				lease.Expires = now.Add(server.config.SessionTTL)
+			}
+		}
+		state = s
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	node.mu.Lock()
+	node.state = state
+	applyPeers := state.PeersRevision != node.peersRevision
+	node.peersRevision = state.PeersRevision
+	node.mu.Unlock()
+
+	var moved []string
+	server.clientsMu.RLock()
+	for id, client := range server.clients {
+		if lease := state.Leases[client.IP]; lease != nil && lease.Node != node.name {
+			moved = append(moved, id)
+		}
+	}
+	server.clientsMu.RUnlock()
+	for _, id := range moved {
+		server.kickClient(id, "session resumed on another node")
+	}
+	if applyPeers && state.PeersRevision > 0 {
+		revoked := server.setPeers(state.Peers)
+		logrus.Infof("Applied peers shared by the cluster, %d sessions disconnected", revoked)
+	}
+	return nil
+}
+
+// clusterPeers returns the peers shared by the cluster, nil when there are
+// none.
+func (server *Server) clusterPeers() []config.Peer {
+	if server.cluster == nil {
+		return nil
+	}
+	server.cluster.mu.RLock()
+	defer server.cluster.mu.RUnlock()
+	if server.cluster.state == nil || server.cluster.state.PeersRevision == 0 {
+		return nil
+	}
+	return server.cluster.state.Peers
+}
+
+// sharePeers publishes peers to the other nodes.
+func (server *Server) sharePeers(peers []config.Peer) error {
+	node := server.cluster
+	if node == nil {
+		return nil
+	}
+	var revision uint64
+	err := node.store.Update(func(s *cluster.State) error {
+		s.Peers = peers
+		s.PeersRevision++
+		revision = s.PeersRevision
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	node.mu.Lock()
+	node.peersRevision = revision
+	node.mu.Unlock()
+	return nil
+}
+
+// assignAddresses settles the client's tunnel addresses. A single server
+// takes the IPv4 address the client requested if it is a host address of the
+// subnet that neither the server nor another peer owns. In a cluster the
+// address is leased from the store: the requested one if it is free, the
+// first free one of the subnet otherwise. Peers with an assigned IP always
+// get theirs.
+func (server *Server) assignAddresses(client *Client, peer *config.Peer, ticket *sessionTicket, requested6 []byte, wants6 bool) error {
+	_, subnet, err := net.ParseCIDR(server.config.VPNSubnet)
+	if err != nil {
+		return err
+	}
+	reserved := map[string]bool{server.config.ServerIP: true}
+	server.peersMu.RLock()
+	for _, other := range server.config.Peers {
+		if other.IP != "" && other.Name != peerName(client) {
+			reserved[other.IP] = true
+		}
+	}
+	server.peersMu.RUnlock()
+	fixed := peer != nil && peer.IP != ""
+	node := server.cluster
+	if node == nil || fixed {
+		if err := checkClientIP(client.IP, subnet, reserved); err != nil {
+			return err
+		}
+	}
+	if node == nil {
+		if !wants6 {
+			return nil
+		}
+		client.IP6, err = server.assignIPv6(client.IP, requested6)
+		return err
+	}
+	var ticketID string
+	if ticket != nil {
+		ticketID = ticket.ID
+	}
+	now := time.Now()
+	lease := cluster.Lease{
+		Peer:    peerName(client),
+		Node:    node.name,
+		Expires: now.Add(server.config.SessionTTL),
+	}
+	err = node.store.Update(func(s *cluster.State) error {
+		s.Expire(now)
+		lease.IP = client.IP
+		if !fixed {
+			if lease.IP = s.Allocate(client.IP, ticketID, lease.Peer, subnet, reserved, now); lease.IP == "" {
+				return fmt.Errorf("no free address left in %s", subnet)
+			}
+		}
+		lease.IP6 = ""
+		if wants6 {
+			var err error
+			if lease.IP6, err = server.assignIPv6(lease.IP, requested6); err != nil {
+				return err
+			}
+		}
+		return s.Acquire(lease, ticketID, now)
+	})
+	if err != nil {
+		return err
+	}
+	client.IP, client.IP6 = lease.IP, lease.IP6
+	return nil
+}
+
+// checkClientIP accepts ip if it is a host address of subnet that is not
+// reserved.
+func checkClientIP(ip string, subnet *net.IPNet, reserved map[string]bool) error {
+	parsed := net.ParseIP(ip).To4()
+	if parsed == nil {
+		return fmt.Errorf("invalid IPv4 address %q", ip)
+	}
+	if !subnet.Contains(parsed) {
+		return fmt.Errorf("IP %s is outside %s", ip, subnet)
+	}
+	broadcast := make(net.IP, len(parsed))
+	for i := range parsed {
+		broadcast[i] = subnet.IP.To4()[i] | ^subnet.Mask[len(subnet.Mask)-4+i]
+	}
+	if parsed.Equal(subnet.IP) || parsed.Equal(broadcast) {
+		return fmt.Errorf("IP %s is not a host address of %s", ip, subnet)
+	}
+	if reserved[ip] {
+		return fmt.Errorf("IP %s is reserved", ip)
+	}
+	return nil
+}
+
+// shareTicket lets the client resume with ticket on any node.
+func (server *Server) shareTicket(client *Client, ticket string) {
+	node := server.cluster
+	if node == nil {
+		return
+	}
+	err := node.store.Update(func(s *cluster.State) error {
+		if lease, ok := s.Leases[client.IP]; ok && lease.Node == node.name {
+			lease.Ticket = ticket
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Warnf("failed to share session ticket of %s: %v", client.ID, err)
+	}
+}
+
+func (server *Server) releaseLease(client *Client) {
+	node := server.cluster
+	if node == nil {
+		return
+	}
+	err := node.store.Update(func(s *cluster.State) error {
+		s.Release(client.IP, node.name, client.ticket)
+		return nil
+	})
+	if err != nil {
+		logrus.Warnf("failed to release lease of %s: %v", client.IP, err)
+	}
+}
+
+// clusterTicket finds a ticket issued by another node.
+func (server *Server) clusterTicket(id string) *sessionTicket {
+	node := server.cluster
+	if node == nil {
+		return nil
+	}
+	state, err := node.store.Load()
+	if err != nil {
+		logrus.Warnf("failed to look up session ticket: %v", err)
+		return nil
+	}
+	lease := state.FindTicket(id, time.Now())
+	if lease == nil {
+		return nil
+	}
+	return &sessionTicket{ID: id, IP: lease.IP, Peer: lease.Peer, Expires: lease.Expires}
+}
+
+// forward sends a packet for a client of another node over the link. It
+// returns false if no other node serves dst.
+func (server *Server) forward(dst string, packet []byte) bool {
+	node := server.cluster
+	if node == nil {
+		return false
+	}
+	node.mu.RLock()
+	member := node.state.Route(dst)
+	node.mu.RUnlock()
+	if member == nil || member.Name == node.name {
+		return false
+	}
+	if err := node.link.Send(member.Name, member.Addr, packet); err != nil {
+		server.metrics.dropped.WithLabelValues("forward_error").Inc()
+		logrus.Debugf("Failed to forward packet for %s to node %s: %v", dst, member.Name, err)
+		return true
+	}
+	server.metrics.forwarded.WithLabelValues(directionOut).Inc()
+	return true
+}
+
+// deliverForwarded passes a packet from another node to the local client it
+// is addressed to. It is never forwarded again.
+func (server *Server) deliverForwarded(from string, packet []byte) {
+	parsed, err := protocol.ParseIPPacket(packet)
+	if err != nil {
+		server.metrics.dropped.WithLabelValues("invalid_packet").Inc()
+		return
+	}
+	server.metrics.forwarded.WithLabelValues(directionIn).Inc()
+	client := server.findClient(parsed.DstIp.String())
+	if client == nil {
+		server.metrics.dropped.WithLabelValues("no_session").Inc()
+		logrus.Debugf("No client for %s forwarded by node %s", parsed.DstIp, from)
+		return
+	}
+	server.sendToClient(client, packet)
+}
+
+func (server *Server) clusterInfo() (*clusterInfo, error) {
+	node := server.cluster
+	if node == nil {
+		return nil, errors.New("cluster mode is off")
+	}
+	state, err := node.store.Load()
+	if err != nil {
+		return nil, err
+	}
+	state.Expire(time.Now())
+	info := &clusterInfo{Node: node.name, Members: []*cluster.Member{}, Leases: []*cluster.Lease{}}
+	for _, member := range state.Members {
+		info.Members = append(info.Members, member)
+	}
+	for _, lease := range state.Leases {
+		lease.Ticket = ""
+		info.Leases = append(info.Leases, lease)
+	}
+	sort.Slice(info.Members, func(i, j int) bool { return info.Members[i].Name < info.Members[j].Name })
+	sort.Slice(info.Leases, func(i, j int) bool { return info.Leases[i].IP < info.Leases[j].IP })
+	return info, nil
+}
+
+// leaveCluster removes this node so others stop forwarding to it. The leases
+// of its sessions stay reserved for the clients to resume elsewhere.
+func (server *Server) leaveCluster() {
+	node := server.cluster
+	if node == nil {
+		return
+	}
+	node.link.Close()
+	err := node.store.Update(func(s *cluster.State) error {
+		delete(s.Members, node.name)
+		return nil
+	})
+	if err != nil {
+		logrus.Warnf("failed to leave cluster: %v", err)
+	}
+	node.store.Close()
+}
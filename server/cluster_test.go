@@ -0,0 +1,113 @@
+package server
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"vpn/cluster"
+	"vpn/config"
+)
+
+func newClusterServer(t *testing.T, name string, store cluster.Store) *Server {
+	server, err := NewServer(config.NewServerConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.cluster = &clusterNode{name: name, store: store}
+	return server
+}
+
+func TestTicketResumesOnAnotherNode(t *testing.T) {
+	store, err := cluster.NewFileStore(filepath.Join(t.TempDir(), "cluster.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	nodeA := newClusterServer(t, "a", store)
+	nodeB := newClusterServer(t, "b", store)
+
+	first := &Client{ID: "first", IP: "10.0.0.2"}
+	if err := nodeA.assignAddresses(first, nil, nil, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodeA.addClient(first, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := nodeA.issueTicket(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeA.removeClient(first, false)
+
+	ticket := nodeB.redeemTicket(data)
+	if ticket == nil || ticket.IP != first.IP {
+		t.Fatalf("node b redeemed %+v, want the ticket for %s", ticket, first.IP)
+	}
+	resumed := &Client{ID: "resumed", IP: ticket.IP}
+	if err := nodeB.assignAddresses(resumed, nil, ticket, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if resumed.IP != first.IP {
+		t.Fatalf("resumed with %s, want %s", resumed.IP, first.IP)
+	}
+	if err := nodeB.addClient(resumed, ticket); err != nil {
+		t.Fatal(err)
+	}
+	state, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease := state.Leases[first.IP]; lease == nil || lease.Node != "b" {
+		t.Fatalf("lease of %s is %+v, want it on node b", first.IP, lease)
+	}
+
+	other := &Client{ID: "other", IP: first.IP}
+	if err := nodeA.assignAddresses(other, nil, nil, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if other.IP == first.IP {
+		t.Fatalf("client without the ticket got %s", other.IP)
+	}
+}
+
+func TestCheckClientIP(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+	reserved := map[string]bool{"10.0.0.1": true, "10.0.0.5": true}
+	tests := []struct {
+		ip string
+		ok bool
+	}{
+		{"10.0.0.2", true},
+		{"10.0.0.254", true},
+		{"10.0.0.1", false},
+		{"10.0.0.5", false},
+		{"10.0.0.0", false},
+		{"10.0.0.255", false},
+		{"10.0.1.2", false},
+		{"fd00::2", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if err := checkClientIP(test.ip, subnet, reserved); (err == nil) != test.ok {
+			t.Errorf("checkClientIP(%q) = %v, want ok %v", test.ip, err, test.ok)
+		}
+	}
+}
+
+func TestSingleServerRejectsReservedIP(t *testing.T) {
+	cfg := config.NewServerConfig()
+	cfg.Peers = []config.Peer{{Name: "alice", IP: "10.0.0.7"}}
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{cfg.ServerIP, "10.0.0.7", "192.168.1.2"} {
+		if err := server.assignAddresses(&Client{IP: ip}, nil, nil, nil, false); err == nil {
+			t.Errorf("client without a peer took %s", ip)
+		}
+	}
+	alice := &cfg.Peers[0]
+	if err := server.assignAddresses(&Client{IP: alice.IP, Peer: alice}, alice, nil, nil, false); err != nil {
+		t.Errorf("alice could not take its assigned IP: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bytes"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	stopped bool
+}
+
+func (conn *recordingConn) Read(p []byte) (int, error) {
+	n, err := conn.Conn.Read(p)
+	conn.mu.Lock()
+	if !conn.stopped {
+		conn.buf.Write(p[:n])
+	}
+	conn.mu.Unlock()
+	return n, err
+}
+
+func (conn *recordingConn) Recorded() []byte {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.buf.Bytes()
+}
+
+func (conn *recordingConn) Stop() {
+	conn.mu.Lock()
+	conn.stopped = true
+	conn.buf.Reset()
+	conn.mu.Unlock()
+}
+
+func (server *Server) fallback(conn net.Conn, consumed []byte) {
+	backend, err := net.DialTimeout("tcp", server.config.FallbackAddr, 5*time.Second)
+	if err != nil {
+		logrus.Errorf("failed to dial fallback backend %s: %v", server.config.FallbackAddr, err)
+		return
+	}
+	defer backend.Close()
+	logrus.Debugf("forwarding %s to fallback backend %s", conn.RemoteAddr(), server.config.FallbackAddr)
+	conn.SetReadDeadline(time.Time{})
+	if len(consumed) > 0 {
+		if _, err := backend.Write(consumed); err != nil {
+			logrus.Errorf("failed to write to fallback backend: %v", err)
+			return
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(conn, backend)
+		conn.Close()
+		close(done)
+	}()
+	io.Copy(backend, conn)
+	if tcpConn, ok := backend.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+	}
+	<-done
+}
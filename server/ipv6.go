@@ -0,0 +1,52 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// mapIPv6 places the host part of ip4 within subnet4 at the same offset in
+// subnet6, so every tunnel IPv4 address has a fixed IPv6 counterpart.
+func mapIPv6(ip4, subnet4 string, subnet6 *net.IPNet) (net.IP, error) {
+	ip := net.ParseIP(ip4).To4()
+	_, network, err := net.ParseCIDR(subnet4)
+	if ip == nil || err != nil || !network.Contains(ip) {
+		return nil, fmt.Errorf("%s is not an address in %s", ip4, subnet4)
+	}
+	offset := binary.BigEndian.Uint32(ip) - binary.BigEndian.Uint32(network.IP.To4())
+	mapped := make(net.IP, net.IPv6len)
+	copy(mapped, subnet6.IP.To16())
+	binary.BigEndian.PutUint32(mapped[12:], binary.BigEndian.Uint32(mapped[12:])+offset)
+	if !subnet6.Contains(mapped) {
+		return nil, fmt.Errorf("%s does not fit into %s", ip4, subnet6)
+	}
+	return mapped, nil
+}
+
+// assignIPv6 picks the client's tunnel IPv6 address: the one it asked for if
+// that lies in the IPv6 subnet, otherwise the address mapped from its IPv4
+// address ip. Without an IPv6 subnet the tunnel stays IPv4 only and the
+// result is "".
+func (server *Server) assignIPv6(ip4 string, requested []byte) (string, error) {
+	if server.subnet6 == nil {
+		return "", nil
+	}
+	if len(requested) > 0 {
+		ip := net.ParseIP(string(requested))
+		if ip == nil || ip.To4() != nil || !server.subnet6.Contains(ip) {
+			return "", fmt.Errorf("requested IPv6 address %s is not in %s", requested, server.subnet6)
+		}
+		return ip.String(), nil
+	}
+	ip, err := mapIPv6(ip4, server.config.VPNSubnet, server.subnet6)
+	if err != nil {
+		return "", err
+	}
+	return ip.String(), nil
+}
+
+func (server *Server) ipv6Ack(ip string) []byte {
+	ones, _ := server.subnet6.Mask.Size()
+	return []byte(fmt.Sprintf("%s/%d", ip, ones))
+}
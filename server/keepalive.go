@@ -0,0 +1,73 @@
+package server
+
+import (
+	"github.com/sirupsen/logrus"
+	"time"
+	"vpn/protocol"
+)
+
+const (
+	minKeepAliveInterval = time.Second
+	maxKeepAliveInterval = 5 * time.Minute
+)
+
+// negotiateKeepAlive accepts the client's keepalive proposal within sane
+// bounds. The timeout always leaves room for at least two keepalives.
+func negotiateKeepAlive(data []byte) (protocol.KeepAliveParams, error) {
+	params, err := protocol.ParseKeepAliveParams(data)
+	if err != nil {
+		return params, err
+	}
+	if params.Interval < minKeepAliveInterval {
+		params.Interval = minKeepAliveInterval
+	}
+	if params.Interval > maxKeepAliveInterval {
+		params.Interval = maxKeepAliveInterval
+	}
+	if params.Timeout < 2*params.Interval {
+		params.Timeout = 2 * params.Interval
+	}
+	return params, nil
+}
+
+// pingClient sends numbered keepalives to a client that negotiated them and
+// closes the connection once too many go unanswered.
+func (server *Server) pingClient(client *Client, stop <-chan struct{}) {
+	ticker := time.NewTicker(client.KeepAlive.Interval)
+	defer ticker.Stop()
+	maxMissed := client.KeepAlive.MaxMissed()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if missed := client.tracker.Missed(); missed >= maxMissed {
+				logrus.Warnf("Client %s did not answer %d keepalives", client.ID, missed)
+				client.Conn.Close()
+				return
+			}
+			if err := client.send(client.tracker.Ping()); err != nil {
+				logrus.Warnf("failed to queue keep alive for %s: %v", client.ID, err)
+			}
+		}
+	}
+}
+
+// handleKeepAlive answers a client's keepalive or records the round trip of
+// one of ours. Clients without numbered keepalives get an empty echo.
+func (server *Server) handleKeepAlive(client *Client, data []byte) error {
+	reply := protocol.NewMessage(protocol.TypeKeepAlive, nil)
+	if len(data) > 0 {
+		var rtt time.Duration
+		var err error
+		if reply, rtt, err = client.tracker.Handle(data); err != nil {
+			return err
+		}
+		if reply == nil {
+			server.metrics.keepAliveRTT.Observe(rtt.Seconds())
+			logrus.Debugf("Keep-alive from %s (rtt %v)", client.ID, rtt)
+			return nil
+		}
+	}
+	return client.send(reply)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"vpn/metrics"
+)
+
+const (
+	directionIn  = "in"
+	directionOut = "out"
+)
+
+type serverMetrics struct {
+	registry        *prometheus.Registry
+	handshakes      *prometheus.CounterVec
+	bytes           *prometheus.CounterVec
+	packets         *prometheus.CounterVec
+	decryptFailures prometheus.Counter
+	tunErrors       *prometheus.CounterVec
+	dropped         *prometheus.CounterVec
+	keepAliveRTT    prometheus.Histogram
+	forwarded       *prometheus.CounterVec
+}
+
+func newServerMetrics(server *Server) *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		handshakes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace, Subsystem: "server", Name: "handshakes_total",
+			Help: "Handshakes by result (ok, resumed, failed, rejected).",
+		}, []string{"result"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace, Subsystem: "server", Name: "bytes_total",
+			Help: "Tunneled IP bytes per peer and direction (in is client to server).",
+		}, []string{"peer", "direction"}),
+		packets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace, Subsystem: "server", Name: "packets_total",
+			Help: "Tunneled IP packets per peer and direction.",
+		}, []string{"peer", "direction"}),
+		decryptFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metrics.Namespace, Subsystem: "server", Name: "decrypt_failures_total",
+			Help: "Data messages that failed to decrypt.",
+		}),
+		tunErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace, Subsystem: "server", Name: "tun_errors_total",
+			Help: "TUN device errors by operation (read, write).",
+		}, []string{"op"}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace, Subsystem: "server", Name: "dropped_packets_total",
+			Help: "Packets dropped by reason.",
+		}, []string{"reason"}),
+		keepAliveRTT: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metrics.Namespace, Subsystem: "server", Name: "keepalive_rtt_seconds",
+			Help:    "Round trip time of keepalives to clients.",
+			Buckets: metrics.RTTBuckets,
+		}),
+		forwarded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metrics.Namespace, Subsystem: "server", Name: "forwarded_packets_total",
+			Help: "Packets exchanged with other cluster nodes by direction (out is to another node).",
+		}, []string{"direction"}),
+	}
+	activeSessions := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace, Subsystem: "server", Name: "active_sessions",
+		Help: "Connected clients.",
+	}, func() float64 {
+		server.clientsMu.RLock()
+		defer server.clientsMu.RUnlock()
+		return float64(len(server.clients))
+	})
+	sendQueue := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace, Subsystem: "server", Name: "send_queue_messages",
+		Help: "Messages waiting in the send queues of all clients.",
+	}, func() float64 {
+		server.clientsMu.RLock()
+		defer server.clientsMu.RUnlock()
+		queued := 0
+		for _, client := range server.clients {
+			queued += len(client.queue)
+		}
+		return float64(queued)
+	})
+	forwardQueue := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace, Subsystem: "server", Name: "forward_queue_packets",
+		Help: "Packets waiting to be forwarded to other cluster nodes.",
+	}, func() float64 {
+		if server.cluster == nil || server.cluster.link == nil {
+			return 0
+		}
+		return float64(server.cluster.link.Queued())
+	})
+	m.registry.MustRegister(m.handshakes, m.bytes, m.packets, m.decryptFailures, m.tunErrors, m.dropped,
+		m.keepAliveRTT, m.forwarded, activeSessions, sendQueue, forwardQueue)
+	return m
+}
+
+// anonymousPeer labels the traffic of clients without a peer name, so
+// sessions without mTLS do not add a series per tunnel IP.
+const anonymousPeer = "anonymous"
+
+// peerLabel names a client by peer name, or anonymousPeer without mTLS.
+func peerLabel(client *Client) string {
+	if name := peerName(client); name != "" {
+		return name
+	}
+	return anonymousPeer
+}
+
+func (m *serverMetrics) transferred(client *Client, direction string, n int) {
+	label := peerLabel(client)
+	m.bytes.WithLabelValues(label, direction).Add(float64(n))
+	m.packets.WithLabelValues(label, direction).Inc()
+}
+
+func (m *serverMetrics) forgetPeer(name string) {
+	for _, direction := range []string{directionIn, directionOut} {
+		m.bytes.DeleteLabelValues(name, direction)
+		m.packets.DeleteLabelValues(name, direction)
+	}
+}
+
+// forgetPeer drops the traffic series of a removed peer. While a session of
+// it is still connected removeClient drops them when the session ends.
+func (server *Server) forgetPeer(name string) {
+	server.clientsMu.RLock()
+	connected := server.peerConnected(name)
+	server.clientsMu.RUnlock()
+	if !connected {
+		server.metrics.forgetPeer(name)
+	}
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"vpn/config"
+	"vpn/protocol"
+)
+
+// negotiateObfs accepts the client's obfuscation proposal within the limits
+// the client settings allow, so no session can make the server hold or
+// inflate its frames beyond them.
+func negotiateObfs(data []byte) (protocol.ObfsParams, error) {
+	params, err := protocol.ParseObfsParams(data)
+	if err != nil {
+		return params, err
+	}
+	if params.MaxPadding > config.MaxObfsPadding {
+		params.MaxPadding = config.MaxObfsPadding
+	}
+	if params.Bucket < 1 {
+		params.Bucket = 1
+	}
+	if params.Bucket > config.MaxObfsBucket {
+		params.Bucket = config.MaxObfsBucket
+	}
+	if params.Jitter > config.MaxObfsJitter {
+		params.Jitter = config.MaxObfsJitter
+	}
+	if params.CoverInterval > 0 && params.CoverInterval < config.MinObfsCover {
+		params.CoverInterval = config.MinObfsCover
+	}
+	return params, nil
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"vpn/config"
+)
+
+// PeerProfile builds the client profile for a peer that reaches the server
+// at endpoints (host:port as seen from the client), by default the configured
+// public endpoints.
+func (server *Server) PeerProfile(name string, endpoints []string) (*config.Profile, error) {
+	server.peersMu.RLock()
+	if len(endpoints) == 0 {
+		endpoints = server.config.PublicEndpoints
+	}
+	dns, routes := server.config.PushDNS, server.config.PushRoutes
+	server.peersMu.RUnlock()
+	if len(endpoints) == 0 {
+		return nil, errors.New("no endpoint given or configured")
+	}
+	for _, endpoint := range endpoints {
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			return nil, fmt.Errorf("invalid endpoint %q, expected host:port", endpoint)
+		}
+	}
+	server.peersMu.RLock()
+	peer := config.FindPeer(server.config.Peers, name)
+	var ip string
+	if peer != nil {
+		ip = peer.IP
+	}
+	server.peersMu.RUnlock()
+	if peer == nil {
+		return nil, fmt.Errorf("peer %q not found", name)
+	}
+	if server.certs == nil {
+		return nil, errors.New("server is not running")
+	}
+	return &config.Profile{
+		Name:    name,
+		Server:  endpoints,
+		Key:     server.config.SharedKey.Hex(),
+		Pin:     server.certs.Pin(),
+		IP:      ip,
+		DNS:     dns,
+		MTU:     server.config.MTU,
+		Include: routes,
+		Obfs:    server.config.Obfuscate,
+	}, nil
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"reflect"
+	"vpn/config"
+)
+
+// restartSettings can only change with a restart; Reload warns about them.
+var restartSettings = []struct {
+	name  string
+	value func(c *config.Config) interface{}
+}{
+	{"listen", func(c *config.Config) interface{} { return c.ListenAddr }},
+	{"ip", func(c *config.Config) interface{} { return c.ServerIP }},
+	{"subnet", func(c *config.Config) interface{} { return c.VPNSubnet }},
+	{"ip6", func(c *config.Config) interface{} { return c.ServerIP6 }},
+	{"subnet6", func(c *config.Config) interface{} { return c.VPNSubnet6 }},
+	{"nat6", func(c *config.Config) interface{} { return c.NAT6 }},
+	{"mtu", func(c *config.Config) interface{} { return c.MTU }},
+	{"key", func(c *config.Config) interface{} { return c.SharedKeyInput }},
+	{"key-file", func(c *config.Config) interface{} { return c.SharedKeyFile }},
+	{"timeout", func(c *config.Config) interface{} { return c.Timeout }},
+	{"obfs", func(c *config.Config) interface{} { return c.Obfuscate }},
+	{"cert", func(c *config.Config) interface{} { return c.TLSCert }},
+	{"tls-key", func(c *config.Config) interface{} { return c.TLSKey }},
+	{"data-dir", func(c *config.Config) interface{} { return c.DataDir }},
+	{"fallback", func(c *config.Config) interface{} { return c.FallbackAddr }},
+	{"mtls", func(c *config.Config) interface{} { return c.RequireClientCert }},
+	{"admin", func(c *config.Config) interface{} { return c.AdminAddr }},
+	{"admin-token", func(c *config.Config) interface{} { return c.AdminToken }},
+	{"metrics", func(c *config.Config) interface{} { return c.MetricsAddr }},
+	{"cluster-store", func(c *config.Config) interface{} { return c.ClusterStore }},
+	{"cluster-node", func(c *config.Config) interface{} { return c.ClusterNode }},
+	{"cluster-listen", func(c *config.Config) interface{} { return c.ClusterListen }},
+	{"cluster-addr", func(c *config.Config) interface{} { return c.ClusterAddr }},
+	{"cluster-key", func(c *config.Config) interface{} { return c.ClusterKey }},
+}
+
+// SetConfigLoader sets how ReloadConfig obtains the new configuration.
+func (server *Server) SetConfigLoader(load func() (*config.Config, error)) {
+	server.loadConfig = load
+}
+
+// ReloadConfig loads the configuration again and applies it.
+func (server *Server) ReloadConfig() error {
+	if server.loadConfig == nil {
+		return errors.New("no configuration to reload")
+	}
+	cfg, err := server.loadConfig()
+	if err != nil {
+		return err
+	}
+	return server.Reload(cfg)
+}
+
+// Reload applies the log level, the peer list and the settings written into
+// generated profiles of cfg to the running server without touching other
+// sessions. In a cluster the shared peers win over those of cfg.
+func (server *Server) Reload(cfg *config.Config) error {
+	level, err := logrus.ParseLevel(cfg.Log)
+	if err != nil {
+		return fmt.Errorf("invalid log level: %s", cfg.Log)
+	}
+	for _, setting := range restartSettings {
+		if !reflect.DeepEqual(setting.value(server.config), setting.value(cfg)) {
+			logrus.Warnf("Reload: %s changed, restart the server to apply it", setting.name)
+		}
+	}
+	if level != logrus.GetLevel() {
+		logrus.SetLevel(level)
+		logrus.Infof("Reload: log level set to %s", level)
+	}
+	server.peersMu.Lock()
+	for _, setting := range []struct {
+		name     string
+		old, new *[]string
+	}{
+		{"endpoint", &server.config.PublicEndpoints, &cfg.PublicEndpoints},
+		{"push-dns", &server.config.PushDNS, &cfg.PushDNS},
+		{"push-routes", &server.config.PushRoutes, &cfg.PushRoutes},
+	} {
+		if !reflect.DeepEqual(*setting.old, *setting.new) {
+			*setting.old = *setting.new
+			logrus.Infof("Reload: %s set to %v for new profiles, connected clients keep the old value", setting.name, *setting.new)
+		}
+	}
+	server.peersMu.Unlock()
+
+	peers := cfg.Peers
+	if shared := server.clusterPeers(); shared != nil {
+		for _, name := range config.ShadowedPeers(peers, shared) {
+			logrus.Warnf("Reload: peer %s of the configuration file is overridden by the cluster store", name)
+		}
+		peers = config.MergePeers(peers, shared)
+	}
+	revoked := server.setPeers(peers)
+	logrus.Infof("Configuration reloaded, %d sessions disconnected", revoked)
+	return nil
+}
+
+// setPeers replaces the peer list. Sessions of peers that were removed,
+// disabled or moved to another IP are disconnected; the others pick up their
+// new ACL. It returns the number of disconnected sessions.
+func (server *Server) setPeers(peers []config.Peer) int {
+	server.peersMu.Lock()
+	old := server.config.Peers
+	server.config.Peers = peers
+	server.peersMu.Unlock()
+	for _, peer := range peers {
+		if config.FindPeer(old, peer.Name) == nil {
+			logrus.Infof("Peer %s added", peer.Name)
+		}
+	}
+	for _, peer := range old {
+		if config.FindPeer(peers, peer.Name) == nil {
+			logrus.Infof("Peer %s removed", peer.Name)
+			server.forgetPeer(peer.Name)
+		}
+	}
+
+	server.clientsMu.RLock()
+	var revoked []string
+	for id, client := range server.clients {
+		if client.Peer == nil {
+			continue
+		}
+		peer := config.FindPeer(peers, client.Peer.Name)
+		if peer == nil || peer.Disabled || (peer.IP != "" && peer.IP != client.IP) {
+			revoked = append(revoked, id)
+			continue
+		}
+		client.mu.Lock()
+		client.acl = peerACL(peer)
+		client.mu.Unlock()
+	}
+	server.clientsMu.RUnlock()
+	for _, id := range revoked {
+		server.kickClient(id, "access revoked")
+	}
+	return len(revoked)
+}
@@ -1,45 +1,86 @@
 package server
 
 import (
+	"crypto/subtle"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"io"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
+	"vpn/cluster"
 	"vpn/config"
 	"vpn/crypto"
+	"vpn/metrics"
 	"vpn/network"
 	"vpn/protocol"
 )
 
+// sendQueueSize is how many messages may wait for a client's writer before
+// more are dropped.
+const sendQueueSize = 100
+
+var errQueueFull = errors.New("send queue full")
+
 type Client struct {
-	ID       string
-	Conn     net.Conn
-	IP       string
-	Cipher   *crypto.Cipher
-	LastSeen time.Time
-	mu       sync.Mutex
+	ID          string
+	Peer        *config.Peer
+	Conn        net.Conn
+	IP          string
+	IP6         string
+	Cipher      *crypto.Cipher
+	Obfs        *protocol.Obfuscator
+	ConnectedAt time.Time
+	LastSeen    time.Time
+	BytesIn     uint64
+	BytesOut    uint64
+	KeepAlive   protocol.KeepAliveParams
+	tracker     *protocol.KeepAliveTracker
+	acl         []*net.IPNet
+	queue       chan *protocol.Message
+	mu          sync.Mutex
+	ticket      string
+	kicked      bool
 }
 
 type Server struct {
-	config    *config.Config
-	tun       *network.TUNInterface
-	clients   map[string]*Client
-	clientsMu sync.RWMutex
-	listener  net.Listener
+	config      *config.Config
+	tun         *network.TUNInterface
+	clients     map[string]*Client
+	clientsMu   sync.RWMutex
+	peersMu     sync.RWMutex // guards config.Peers and the profile settings
+	tickets     map[string]*sessionTicket
+	ticketsMu   sync.Mutex
+	listener    net.Listener
+	subnet6     *net.IPNet
+	admin       *http.Server
+	metrics     *serverMetrics
+	metricsHTTP *http.Server
+	loadConfig  func() (*config.Config, error)
+	certs       *crypto.CertReloader
+
+	clusterStore cluster.Store
+	cluster      *clusterNode
 
 	tunChan  chan []byte
 	stopChan chan struct{}
 }
 
 func NewServer(config *config.Config) (*Server, error) {
-	return &Server{
+	server := &Server{
 		config:   config,
 		clients:  make(map[string]*Client),
+		tickets:  make(map[string]*sessionTicket),
 		tunChan:  make(chan []byte, 100),
 		stopChan: make(chan struct{}),
-	}, nil
+	}
+	server.metrics = newServerMetrics(server)
+	return server, nil
 }
 
 func (server *Server) Start() error {
@@ -49,15 +90,59 @@ func (server *Server) Start() error {
 	}
 	server.tun = tun
 	logrus.Infof("new tun interface %s with IP %s ", tun.Name(), server.config.ServerIP)
-	tlsConfig, err := crypto.NewServerTSLConfig()
+	if server.config.VPNSubnet6 != "" {
+		if err := server.setupIPv6(); err != nil {
+			return err
+		}
+	}
+	certFile, keyFile := server.config.TLSCert, server.config.TLSKey
+	if certFile == "" || keyFile == "" {
+		certFile = filepath.Join(server.config.DataDir, "server.crt")
+		keyFile = filepath.Join(server.config.DataDir, "server.key")
+		hostname, _ := os.Hostname()
+		if err := crypto.LoadOrCreateSelfSigned(certFile, keyFile, []string{hostname}); err != nil {
+			return fmt.Errorf("create self-signed certificate: %v", err)
+		}
+		logrus.Infof("using self-signed certificate %s", certFile)
+	}
+	reloader, err := crypto.NewCertReloader(certFile, keyFile)
 	if err != nil {
-		return fmt.Errorf("create server tls config: %v", err)
+		return fmt.Errorf("load tls certificate: %v", err)
+	}
+	logrus.Infof("TLS certificate pin: %s", reloader.Pin())
+	server.certs = reloader
+	go reloader.Watch(30*time.Second, server.stopChan)
+	tlsConfig := crypto.NewServerTSLConfig(reloader)
+	if server.config.RequireClientCert {
+		ca, err := crypto.LoadOrCreateCA(filepath.Join(server.config.DataDir, "ca"))
+		if err != nil {
+			return fmt.Errorf("load client CA: %v", err)
+		}
+		// with a fallback backend, probes without a certificate must still
+		// complete TLS so they can be forwarded; the check moves to identifyPeer
+		crypto.EnableClientAuth(tlsConfig, ca, server.config.FallbackAddr != "")
+		logrus.Infof("client certificates required, %d peers configured", len(server.config.Peers))
+	}
+	if err := server.startCluster(); err != nil {
+		return err
 	}
 	listener, err := tls.Listen("tcp", server.config.ListenAddr, tlsConfig)
 	if err != nil {
 		return fmt.Errorf("create server listener: %v", err)
 	}
 	server.listener = listener
+	if server.config.AdminAddr != "" {
+		if err := server.startAdmin(); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	if server.config.MetricsAddr != "" {
+		if server.metricsHTTP, err = metrics.Serve(server.config.MetricsAddr, server.metrics.registry); err != nil {
+			listener.Close()
+			return err
+		}
+	}
 	go server.tunReader()
 	go server.clientCleaner()
 
@@ -77,48 +162,167 @@ func (server *Server) Start() error {
 	}
 }
 
+func (server *Server) setupIPv6() error {
+	_, subnet6, err := net.ParseCIDR(server.config.VPNSubnet6)
+	if err != nil || subnet6.IP.To4() != nil {
+		return fmt.Errorf("invalid IPv6 subnet %s", server.config.VPNSubnet6)
+	}
+	server.subnet6 = subnet6
+	serverIP6 := server.config.ServerIP6
+	if serverIP6 == "" {
+		ip, err := mapIPv6(server.config.ServerIP, server.config.VPNSubnet, subnet6)
+		if err != nil {
+			return fmt.Errorf("derive server IPv6 address: %v", err)
+		}
+		serverIP6 = ip.String()
+	}
+	if err := server.tun.ConfigureIPv6(serverIP6, server.config.VPNSubnet6, server.config.NAT6); err != nil {
+		return err
+	}
+	logrus.Infof("IPv6 enabled with IP %s in %s (NAT: %s)", serverIP6, subnet6, server.config.NAT6)
+	return nil
+}
+
 func (server *Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
 	clientAddr := conn.RemoteAddr().String()
 	logrus.Infof("new client connection from %s", clientAddr)
-	message, err := protocol.ReadMessage(conn)
-	if err != nil {
-		logrus.Errorf("failed to read handshake: %v", err)
+	recorder := &recordingConn{Conn: conn}
+	conn.SetReadDeadline(time.Now().Add(server.config.HandshakeTimeout))
+	handshake, err := server.readHandshake(recorder)
+	if err == io.EOF {
+		// clients with several endpoints close the slower connections
+		logrus.Debugf("client %s closed the connection before the handshake", clientAddr)
 		return
 	}
-	if message.Header.Type != protocol.TypeHandshake {
-		logrus.Errorf("expected handshake but got: %v", message.Header.Type)
-	}
-	handshake, err := protocol.ParseHandshake(message.Data)
 	if err != nil {
-		logrus.Errorf("failed to parse handshake: %v", err)
+		server.metrics.handshakes.WithLabelValues("failed").Inc()
+		logrus.Warnf("handshake from %s failed: %v", clientAddr, err)
+		if server.config.FallbackAddr != "" {
+			server.fallback(conn, recorder.Recorded())
+		}
 		return
 	}
+	recorder.Stop()
+	var peer *config.Peer
+	if server.config.RequireClientCert {
+		// the handshake proved the shared key, so the recorded bytes must
+		// not reach the fallback backend
+		if peer, err = server.identifyPeer(conn, handshake); err != nil {
+			server.metrics.handshakes.WithLabelValues("failed").Inc()
+			logrus.Warnf("handshake from %s failed: %v", clientAddr, err)
+			return
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
 	cipher, err := crypto.NewCipher(server.config.SharedKey)
 	if err != nil {
 		logrus.Errorf("failed to create cipher: %v", err)
 		return
 	}
 	client := &Client{
-		ID:       clientAddr,
-		Conn:     conn,
-		IP:       handshake.ClientIP,
-		Cipher:   cipher,
-		LastSeen: time.Now(),
+		ID:          clientAddr,
+		Peer:        peer,
+		Conn:        conn,
+		IP:          handshake.ClientIP,
+		Cipher:      cipher,
+		ConnectedAt: time.Now(),
+		LastSeen:    time.Now(),
+		tracker:     protocol.NewKeepAliveTracker(),
+		acl:         peerACL(peer),
+		queue:       make(chan *protocol.Message, sendQueueSize),
 	}
 
-	server.clientsMu.Lock()
-	server.clients[client.ID] = client
-	server.clientsMu.Unlock()
+	requested6, wants6 := handshake.Extensions[protocol.ExtIPv6]
+	ticket := server.redeemTicket(handshake.Extensions[protocol.ExtSessionTicket])
+	err = server.assignAddresses(client, peer, ticket, requested6, wants6)
+	if err == nil {
+		if err = server.addClient(client, ticket); err != nil {
+			server.releaseLease(client)
+		}
+	}
+	if err != nil {
+		server.metrics.handshakes.WithLabelValues("rejected").Inc()
+		logrus.Warnf("rejecting client %s: %v", clientAddr, err)
+		errorMessage := protocol.NewMessage(protocol.TypeError, []byte(err.Error()))
+		protocol.WriteMessage(conn, errorMessage)
+		return
+	}
+	released := false
+	defer func() {
+		client.mu.Lock()
+		// a kicked client gives up its IP instead of keeping it reserved
+		released = released || client.kicked
+		client.mu.Unlock()
+		server.removeClient(client, released)
+		logrus.Infof("Client %s removed", clientAddr)
+	}()
 
-	ackMessage := protocol.NewMessage(protocol.TypeHandshakeAck, []byte("OK"))
+	ackExt := protocol.Extensions{protocol.ExtIPv4: []byte(client.IP)}
+	ticketData, err := server.issueTicket(client)
+	if err != nil {
+		logrus.Errorf("failed to issue session ticket: %v", err)
+		return
+	}
+	ackExt[protocol.ExtSessionTicket] = ticketData
+	if client.IP6 != "" {
+		ackExt[protocol.ExtIPv6] = server.ipv6Ack(client.IP6)
+	}
+	if data, ok := handshake.Extensions[protocol.ExtKeepAlive]; ok {
+		if client.KeepAlive, err = negotiateKeepAlive(data); err != nil {
+			logrus.Errorf("failed to parse keepalive params: %v", err)
+			return
+		}
+		ackExt[protocol.ExtKeepAlive] = client.KeepAlive.Marshal()
+	}
+	if data, ok := handshake.Extensions[protocol.ExtObfuscation]; ok && server.config.Obfuscate {
+		params, err := negotiateObfs(data)
+		if err != nil {
+			logrus.Errorf("failed to parse obfuscation params: %v", err)
+			return
+		}
+		client.Obfs = protocol.NewObfuscator(params)
+		ackExt[protocol.ExtObfuscation] = params.Marshal()
+	}
+
+	ackMessage := protocol.CreateHandshakeAck(ackExt)
 	if err := protocol.WriteMessage(conn, ackMessage); err != nil {
 		logrus.Errorf("failed to send ack message: %v", err)
 		return
 	}
-	logrus.Infof("Client %s authenticated with IP %s", clientAddr, handshake.ClientIP)
+	writerStop := make(chan struct{})
+	defer close(writerStop)
+	go client.writer(writerStop)
+	if ticket != nil {
+		server.metrics.handshakes.WithLabelValues("resumed").Inc()
+		logrus.Infof("Client %s resumed session with IP %s", clientAddr, client.IP)
+	} else {
+		server.metrics.handshakes.WithLabelValues("ok").Inc()
+		if peer != nil {
+			logrus.Infof("Client %s authenticated as peer %s with IP %s", clientAddr, peer.Name, client.IP)
+		} else {
+			logrus.Infof("Client %s authenticated with IP %s", clientAddr, client.IP)
+		}
+	}
+	if client.IP != handshake.ClientIP {
+		logrus.Infof("Client %s requested IP %s, which is taken", clientAddr, handshake.ClientIP)
+	}
+	if client.IP6 != "" {
+		logrus.Infof("Client %s uses IPv6 address %s", clientAddr, client.IP6)
+	}
+	if client.Obfs != nil {
+		logrus.Infof("Client %s uses traffic obfuscation", clientAddr)
+		coverStop := make(chan struct{})
+		defer close(coverStop)
+		go client.Obfs.RunCover(coverStop, client.send)
+	}
+	if client.KeepAlive.Interval > 0 {
+		pingStop := make(chan struct{})
+		defer close(pingStop)
+		go server.pingClient(client, pingStop)
+	}
 	for {
-		message, err := protocol.ReadMessage(conn)
+		message, err := client.Obfs.ReadMessage(conn)
 		if err != nil {
 			logrus.Errorf("failed to read message: %v", err)
 			break
@@ -131,36 +335,95 @@ func (server *Server) handleConnection(conn net.Conn) {
 		case protocol.TypeData:
 			plaintext, err := cipher.Decrypt(message.Data)
 			if err != nil {
+				server.metrics.decryptFailures.Inc()
 				logrus.Errorf("failed to decrypt message: %v", err)
 				continue
 			}
 			packet, err := protocol.ParseIPPacket(plaintext)
 			if err != nil {
+				server.metrics.dropped.WithLabelValues("invalid_packet").Inc()
 				logrus.Errorf("failed to parse packet: %v", err)
 				continue
 			}
 			logrus.Debugf("Received %s packet from %s to %s (%d bytes)",
 				packet.ProtocolName(), packet.SrcIp, packet.DstIp, len(plaintext))
+			if !client.owns(packet.SrcIp) {
+				server.metrics.dropped.WithLabelValues("spoofed").Inc()
+				logrus.Debugf("Dropping packet from %s with source %s: not its address", client.ID, packet.SrcIp)
+				continue
+			}
+			if !client.permits(packet.DstIp) {
+				server.metrics.dropped.WithLabelValues("acl").Inc()
+				logrus.Debugf("Dropping packet from %s to %s: not allowed", client.ID, packet.DstIp)
+				continue
+			}
 			if _, err := server.tun.Write(plaintext); err != nil {
+				server.metrics.tunErrors.WithLabelValues("write").Inc()
 				logrus.Errorf("failed to write to TUN: %v", err)
 				continue
 			}
+			client.mu.Lock()
+			client.BytesIn += uint64(len(plaintext))
+			client.mu.Unlock()
+			server.metrics.transferred(client, directionIn, len(plaintext))
 		case protocol.TypeKeepAlive:
-			keepAliveMessage := protocol.NewMessage(protocol.TypeKeepAlive, nil)
-			if err := protocol.WriteMessage(conn, keepAliveMessage); err != nil {
-				logrus.Errorf("failed to write keep alive: %v", err)
+			if err := server.handleKeepAlive(client, message.Data); err != nil {
+				logrus.Errorf("failed to handle keep alive: %v", err)
 				continue
 			}
 		case protocol.TypeDisconnect:
 			logrus.Infof("Client %s disconnected", clientAddr)
+			released = true
 			return
 		}
 	}
-	server.clientsMu.Lock()
-	delete(server.clients, client.ID)
-	server.clientsMu.Unlock()
+}
 
-	logrus.Infof("Client %s removed", clientAddr)
+func (server *Server) readHandshake(conn net.Conn) (*protocol.HandshakeMsg, error) {
+	message, err := protocol.ReadMessage(conn)
+	if err == io.EOF {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read handshake: %v", err)
+	}
+	if message.Header.Type != protocol.TypeHandshake {
+		return nil, fmt.Errorf("expected handshake but got: %v", message.Header.Type)
+	}
+	handshake, err := protocol.ParseHandshake(message.Data)
+	if err != nil {
+		return nil, fmt.Errorf("parse handshake: %v", err)
+	}
+	if subtle.ConstantTimeCompare(handshake.SharedKey, server.config.SharedKey) != 1 {
+		return nil, fmt.Errorf("shared key mismatch")
+	}
+	return handshake, nil
+}
+
+func (server *Server) identifyPeer(conn net.Conn, handshake *protocol.HandshakeMsg) (*config.Peer, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, fmt.Errorf("not a TLS connection")
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return nil, fmt.Errorf("no client certificate")
+	}
+	name := crypto.CertIdentity(state.VerifiedChains[0][0])
+	server.peersMu.RLock()
+	defer server.peersMu.RUnlock()
+	peer := config.FindPeer(server.config.Peers, name)
+	if peer == nil {
+		return nil, fmt.Errorf("unknown peer %q", name)
+	}
+	if peer.Disabled {
+		return nil, fmt.Errorf("peer %q is disabled", name)
+	}
+	if peer.IP != "" && peer.IP != handshake.ClientIP {
+		return nil, fmt.Errorf("peer %q requested IP %s but is assigned %s", name, handshake.ClientIP, peer.IP)
+	}
+	found := *peer
+	return &found, nil
 }
 
 func (server *Server) tunReader() {
@@ -172,40 +435,89 @@ func (server *Server) tunReader() {
 		default:
 			n, err := server.tun.Read(buffer)
 			if err != nil {
+				server.metrics.tunErrors.WithLabelValues("read").Inc()
 				logrus.Errorf("tun read error: %v", err)
 				continue
 			}
 			packet, err := protocol.ParseIPPacket(buffer[:n])
 			if err != nil {
+				server.metrics.dropped.WithLabelValues("invalid_packet").Inc()
 				logrus.Errorf("parse packet error: %v", err)
 				continue
 			}
 			logrus.Debugf("Read %s packet from TUN: %s to %s (%d bytes)",
 				packet.ProtocolName(), packet.SrcIp, packet.DstIp, n)
-			server.clientsMu.Lock()
-			var targetClient *Client
-			for _, client := range server.clients {
-				if client.IP == packet.DstIp.String() {
-					targetClient = client
-					break
-				}
-			}
-			server.clientsMu.Unlock()
+			dst := packet.DstIp.String()
+			targetClient := server.findClient(dst)
 			if targetClient == nil {
+				if server.forward(dst, buffer[:n]) {
+					continue
+				}
+				server.metrics.dropped.WithLabelValues("no_session").Inc()
 				logrus.Debugf("No client found for IP %s", packet.DstIp)
 				continue
 			}
-			ciphertext, err := targetClient.Cipher.Encrypt(buffer[:n])
-			if err != nil {
-				logrus.Errorf("cipher encrypt error: %v", err)
-				continue
+			server.sendToClient(targetClient, buffer[:n])
+		}
+	}
+}
+
+func (server *Server) findClient(dst string) *Client {
+	server.clientsMu.RLock()
+	defer server.clientsMu.RUnlock()
+	for _, client := range server.clients {
+		if client.IP == dst || (client.IP6 != "" && client.IP6 == dst) {
+			return client
+		}
+	}
+	return nil
+}
+
+func (server *Server) sendToClient(client *Client, packet []byte) {
+	ciphertext, err := client.Cipher.Encrypt(packet)
+	if err != nil {
+		server.metrics.dropped.WithLabelValues("encrypt_error").Inc()
+		logrus.Errorf("cipher encrypt error: %v", err)
+		return
+	}
+	message := protocol.NewMessage(protocol.TypeData, ciphertext)
+	if err := client.send(message); err != nil {
+		server.metrics.dropped.WithLabelValues("queue_full").Inc()
+		logrus.Debugf("Dropping packet for %s: %v", client.ID, err)
+		return
+	}
+	client.mu.Lock()
+	client.BytesOut += uint64(len(packet))
+	client.mu.Unlock()
+	server.metrics.transferred(client, directionOut, len(packet))
+}
+
+// send queues message for the client's writer. It never blocks, so a slow
+// client cannot hold up the TUN reader that serves everyone.
+func (client *Client) send(message *protocol.Message) error {
+	select {
+	case client.queue <- message:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// writer is the only goroutine that writes to the client after the handshake.
+func (client *Client) writer(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case message := <-client.queue:
+			err := client.Obfs.WriteMessage(client.Conn, message)
+			if err == nil && message.Header.Type == protocol.TypeDisconnect {
+				err = errors.New("disconnected")
 			}
-			message := protocol.NewMessage(protocol.TypeData, ciphertext)
-			targetClient.mu.Lock()
-			err = protocol.WriteMessage(targetClient.Conn, message)
-			targetClient.mu.Unlock()
 			if err != nil {
-				logrus.Errorf("write message error: %v", err)
+				logrus.Debugf("Writer of %s stopped: %v", client.ID, err)
+				client.Conn.Close()
+				return
 			}
 		}
 	}
@@ -223,7 +535,11 @@ func (server *Server) clientCleaner() {
 			server.clientsMu.Lock()
 			for _, client := range server.clients {
 				client.mu.Lock()
-				if now.Sub(client.LastSeen) > server.config.Timeout {
+				timeout := server.config.Timeout
+				if client.KeepAlive.Timeout > 0 {
+					timeout = client.KeepAlive.Timeout
+				}
+				if now.Sub(client.LastSeen) > timeout {
 					logrus.Infof("Removing client %s", client.ID)
 					client.Conn.Close()
 					delete(server.clients, client.ID)
@@ -231,6 +547,7 @@ func (server *Server) clientCleaner() {
 				client.mu.Unlock()
 			}
 			server.clientsMu.Unlock()
+			server.expireTickets()
 		}
 	}
 }
@@ -240,6 +557,11 @@ func (server *Server) Stop() error {
 	if server.listener != nil {
 		server.listener.Close()
 	}
+	server.leaveCluster()
+	server.stopAdmin()
+	if server.metricsHTTP != nil {
+		server.metricsHTTP.Close()
+	}
 	if server.tun != nil {
 		server.tun.Close()
 	}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"time"
+	"vpn/config"
+)
+
+type sessionTicket struct {
+	ID      string
+	IP      string
+	Peer    string
+	Expires time.Time
+}
+
+func peerName(client *Client) string {
+	if client.Peer == nil {
+		return ""
+	}
+	return client.Peer.Name
+}
+
+func (server *Server) redeemTicket(data []byte) *sessionTicket {
+	if len(data) == 0 {
+		return nil
+	}
+	id := hex.EncodeToString(data)
+	server.ticketsMu.Lock()
+	ticket, ok := server.tickets[id]
+	server.ticketsMu.Unlock()
+	if !ok || time.Now().After(ticket.Expires) {
+		// the client may resume a session of another node
+		return server.clusterTicket(id)
+	}
+	return ticket
+}
+
+func (server *Server) issueTicket(client *Client) ([]byte, error) {
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		return nil, err
+	}
+	ticket := &sessionTicket{
+		ID:   hex.EncodeToString(data),
+		IP:   client.IP,
+		Peer: peerName(client),
+		// a live session keeps its ticket; the TTL starts when it ends
+		Expires: time.Now().Add(100 * 365 * 24 * time.Hour),
+	}
+	server.ticketsMu.Lock()
+	for id, existing := range server.tickets {
+		if existing.IP == client.IP {
+			delete(server.tickets, id)
+		}
+	}
+	server.tickets[ticket.ID] = ticket
+	server.ticketsMu.Unlock()
+	client.ticket = ticket.ID
+	server.shareTicket(client, ticket.ID)
+	return data, nil
+}
+
+// addClient registers client unless its tunnel IP belongs to another live
+// session or to a ticket held by someone else. A client resuming with a valid
+// ticket replaces the stale session that still holds its IP.
+func (server *Server) addClient(client *Client, ticket *sessionTicket) error {
+	resuming := ticket != nil && ticket.IP == client.IP && ticket.Peer == peerName(client)
+	if !resuming {
+		server.ticketsMu.Lock()
+		for _, reserved := range server.tickets {
+			if reserved.IP == client.IP && time.Now().Before(reserved.Expires) {
+				server.ticketsMu.Unlock()
+				return fmt.Errorf("IP %s is reserved by another session", client.IP)
+			}
+		}
+		server.ticketsMu.Unlock()
+	}
+	server.clientsMu.Lock()
+	defer server.clientsMu.Unlock()
+	for id, existing := range server.clients {
+		if client.IP6 != "" && existing.IP6 == client.IP6 && existing.IP != client.IP {
+			return fmt.Errorf("IPv6 address %s is already in use by %s", client.IP6, existing.ID)
+		}
+		if existing.IP != client.IP {
+			continue
+		}
+		if !resuming {
+			return fmt.Errorf("IP %s is already in use by %s", client.IP, existing.ID)
+		}
+		logrus.Infof("Client %s resumes session of %s", client.ID, existing.ID)
+		existing.Conn.Close()
+		delete(server.clients, id)
+	}
+	server.clients[client.ID] = client
+	return nil
+}
+
+// peerConnected reports whether a session of the peer name is in
+// server.clients; the caller holds clientsMu.
+func (server *Server) peerConnected(name string) bool {
+	for _, client := range server.clients {
+		if peerName(client) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (server *Server) removeClient(client *Client, released bool) {
+	if released {
+		server.releaseLease(client)
+	}
+	// the series of a peer live as long as the peer, across its sessions
+	name := peerName(client)
+	server.peersMu.RLock()
+	removed := name != "" && config.FindPeer(server.config.Peers, name) == nil
+	server.peersMu.RUnlock()
+	server.clientsMu.Lock()
+	if server.clients[client.ID] == client {
+		delete(server.clients, client.ID)
+	}
+	if removed && !server.peerConnected(name) {
+		server.metrics.forgetPeer(name)
+	}
+	server.clientsMu.Unlock()
+
+	server.ticketsMu.Lock()
+	defer server.ticketsMu.Unlock()
+	ticket, ok := server.tickets[client.ticket]
+	if !ok {
+		return
+	}
+	if released {
+		delete(server.tickets, client.ticket)
+		return
+	}
+	ticket.Expires = time.Now().Add(server.config.SessionTTL)
+}
+
+func (server *Server) expireTickets() {
+	now := time.Now()
+	server.ticketsMu.Lock()
+	defer server.ticketsMu.Unlock()
+	for id, ticket := range server.tickets {
+		if now.After(ticket.Expires) {
+			delete(server.tickets, id)
+		}
+	}
+}